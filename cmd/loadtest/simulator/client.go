@@ -1,7 +1,9 @@
 package simulator
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/websocket"
@@ -9,6 +11,13 @@ import (
 	"nakama/server"
 )
 
+const (
+	RPC_CLOCK_SYNC = "clock_sync"
+
+	// number of clock samples the offset estimate is picked from
+	CLOCK_SAMPLES = 8
+)
+
 type NKClient struct {
 	logger *zap.Logger
 	Host   string
@@ -17,6 +26,23 @@ type NKClient struct {
 	conn *websocket.Conn
 
 	UserID string
+
+	clockSamples []clockSample
+	offset       int64
+	rtt          int64
+}
+
+// clockSync is the json payload of the clock_sync rpc, times are unix millis
+type clockSync struct {
+	ClientTime int64 `json:"client_time"`
+	ServerRecv int64 `json:"server_recv"`
+	ServerSend int64 `json:"server_send"`
+	Tick       int64 `json:"tick"`
+}
+
+type clockSample struct {
+	offset int64
+	rtt    int64
 }
 
 func NewNKClient(logger *zap.Logger, host string, port int) *NKClient {
@@ -48,3 +74,69 @@ func (c *NKClient) Send(e *server.Envelope) error {
 func (c *NKClient) Stop() {
 	c.conn.Close()
 }
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// SyncClock sends a clock_sync request, the answer has to be passed to
+// HandleClockSync by whoever reads the connection
+func (c *NKClient) SyncClock() error {
+	payload, err := json.Marshal(&clockSync{ClientTime: nowMillis()})
+	if err != nil {
+		return err
+	}
+	return c.Send(&server.Envelope{Payload: &server.Envelope_Rpc{Rpc: &server.TRpc{Id: RPC_CLOCK_SYNC, Payload: string(payload)}}})
+}
+
+// HandleClockSync updates the offset and rtt estimates from a clock_sync
+// answer, returns false if e is not one
+func (c *NKClient) HandleClockSync(e *server.Envelope) bool {
+	rpc := e.GetRpc()
+	if rpc == nil || rpc.Id != RPC_CLOCK_SYNC {
+		return false
+	}
+	recvAt := nowMillis()
+	resp := &clockSync{}
+	if err := json.Unmarshal([]byte(rpc.Payload), resp); err != nil {
+		c.logger.Warn("Invalid clock sync", zap.Error(err))
+		return true
+	}
+
+	// NTP style: t0 client send, t1 server recv, t2 server send, t3 client recv
+	sample := clockSample{
+		offset: ((resp.ServerRecv - resp.ClientTime) + (resp.ServerSend - recvAt)) / 2,
+		rtt:    (recvAt - resp.ClientTime) - (resp.ServerSend - resp.ServerRecv),
+	}
+	c.clockSamples = append(c.clockSamples, sample)
+	if len(c.clockSamples) > CLOCK_SAMPLES {
+		c.clockSamples = c.clockSamples[1:]
+	}
+
+	// the sample with the lowest rtt has the least asymmetric delay
+	best := c.clockSamples[0]
+	for _, s := range c.clockSamples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	c.offset = best.offset
+	c.rtt = best.rtt
+	c.logger.Debug("Clock synced", zap.Int64("offset", c.offset), zap.Int64("rtt", c.rtt))
+	return true
+}
+
+// Offset returns the estimated server clock minus local clock in millis
+func (c *NKClient) Offset() int64 {
+	return c.offset
+}
+
+// RTT returns the estimated round trip time in millis
+func (c *NKClient) RTT() int64 {
+	return c.rtt
+}
+
+// ServerTime returns the estimated current server time in unix millis
+func (c *NKClient) ServerTime() int64 {
+	return nowMillis() + c.offset
+}
@@ -45,16 +45,19 @@ func (d Direction) String() string {
 	return [...]string{"IN", "OUT"}[d]
 }
 
+const CLOCK_SYNC_INTERVAL = 5 * time.Second
+
 type SyncWorker struct {
-	logger     *zap.Logger
-	client     *NKClient
-	stopped    bool
-	exitCode   ExitCode
-	recvCh     chan *server.Envelope
-	doneCh     chan struct{}
-	sendTicker *time.Ticker
-	interval   int64
-	outDir     string
+	logger      *zap.Logger
+	client      *NKClient
+	stopped     bool
+	exitCode    ExitCode
+	recvCh      chan *server.Envelope
+	doneCh      chan struct{}
+	sendTicker  *time.Ticker
+	clockTicker *time.Ticker
+	interval    int64
+	outDir      string
 
 	name     string
 	customID string
@@ -173,6 +176,10 @@ func (w *SyncWorker) mainLoop() {
 				// monitor the outgoing request
 				w.processSent(e)
 			}
+		case <-w.clockTicker.C:
+			if err := w.client.SyncClock(); err != nil && !w.stopped {
+				fmt.Println("Clock Sync Error:", err)
+			}
 		case e := <-w.recvCh:
 			w.processRecv(e)
 		}
@@ -187,12 +194,18 @@ func (w *SyncWorker) Init() error {
 		fmt.Println("Connect Error:", err)
 		return err
 	}
+	err = w.client.SyncClock()
+	if err != nil {
+		fmt.Println("Clock Sync Error:", err)
+		return err
+	}
 
 	return nil
 }
 
 func (w *SyncWorker) Start() {
 	w.sendTicker = time.NewTicker(time.Millisecond * time.Duration(w.interval))
+	w.clockTicker = time.NewTicker(CLOCK_SYNC_INTERVAL)
 
 	// sending coroutine
 	go w.recvPump()
@@ -204,6 +217,9 @@ func (w *SyncWorker) StopSend() {
 	if w.sendTicker != nil {
 		w.sendTicker.Stop()
 	}
+	if w.clockTicker != nil {
+		w.clockTicker.Stop()
+	}
 }
 
 func (w *SyncWorker) Shutdown(code ExitCode) {
@@ -224,6 +240,9 @@ func (w *SyncWorker) Shutdown(code ExitCode) {
 
 // receive message
 func (w *SyncWorker) processRecv(e *server.Envelope) {
+	if w.client.HandleClockSync(e) {
+		return
+	}
 	hash := e.CollationId
 	if hash == "" {
 		fmt.Println("empty envelope, skip")
@@ -253,8 +272,8 @@ func (w *SyncWorker) processSent(e *server.Envelope) {
 }
 
 func (w *SyncWorker) appendRecord(record *SyncRecord) {
-	millis := time.Now().UnixNano() / int64(time.Millisecond)
-	record.timestamp = millis
+	// server time, so records from different machines are comparable
+	record.timestamp = w.client.ServerTime()
 	w.records = append(w.records, record)
 }
 
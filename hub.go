@@ -1,68 +0,0 @@
-// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-package main
-
-import (
-	"fmt"
-)
-
-type MessageEnvelope struct {
-	fromClient string
-	data       []byte
-}
-
-// hub maintains the set of active clients and broadcasts messages to the
-// clients.
-type Hub struct {
-	// Registered clients.
-	clients map[*Client]bool
-
-	// Inbound messages from the clients.
-	broadcast chan *MessageEnvelope
-
-	// Register requests from the clients.
-	register chan *Client
-
-	// Unregister requests from clients.
-	unregister chan *Client
-}
-
-func newHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan *MessageEnvelope),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-	}
-}
-
-func (h *Hub) run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.clients[client] = true
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-			}
-		case message := <-h.broadcast:
-			// fmt.Println("Broadcast: ", string(message))
-			for client := range h.clients {
-				if client.id == message.fromClient {
-					// skip sending message to itself
-					continue
-				}
-				select {
-				case client.send <- message.data:
-				default:
-					fmt.Println("close client early: ")
-					close(client.send)
-					delete(h.clients, client)
-				}
-			}
-		}
-	}
-}
@@ -5,12 +5,234 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"ws/realtime"
 )
 
 var addr = flag.String("addr", ":8888", "http service address")
+var historyWindow = flag.Duration("history", time.Second, "how far back entity positions are kept for lag compensation")
+var ticketTimeout = flag.Duration("ticket-timeout", 30*time.Second, "how long a matchmaker ticket waits for a match")
+var chatDB = flag.String("chat-db", "chat.db", "chat database file")
+var chatJoinHistory = flag.Int("chat-history", 50, "number of messages sent to a client joining a chat channel")
+var luaDir = flag.String("lua-dir", "", "directory of the Lua modules to load")
+var botCount = flag.Int("bots", 0, "number of bots spawned in each bot space")
+var botSpaces = flag.String("bot-spaces", "", "comma separated spaces to spawn bots in")
+var botPath = flag.String("bot-path", realtime.BotPathRandomWalk, "path of the bots: random or waypoints")
+var botWaypoints = flag.String("bot-waypoints", "", "waypoints of the bots as x,y,z;x,y,z;...")
+var botArea = flag.Float64("bot-area", 20, "half size of the square random walks stay in")
+var botSpeed = flag.Float64("bot-speed", 2, "distance moved by a bot per second")
+var botRate = flag.Int("bot-rate", 10, "updates sent by a bot per second")
+var udpAddr = flag.String("udp", "", "udp address for SpacePresence updates, disabled if empty")
+var handoffTimeout = flag.Duration("handoff", time.Minute, "time a restarted process keeps serving its clients before shutting down")
+var drainTimeout = flag.Duration("drain", 10*time.Second, "time allowed to flush the clients on shutdown")
+var adminAddr = flag.String("admin", "", "admin http service address, disabled if empty")
+var deltaQuantum = flag.Float64("delta-quantum", 0, "quantum of the positions in delta updates, not quantized if zero")
+var deltaKeyframe = flag.Duration("delta-keyframe", 5*time.Second, "period of the full entity updates sent to delta clients")
+var lodBands = flag.String("lod", "", "update rates by distance as distance:rate,distance:rate,..., every update if empty")
+var moveSpeed = flag.Float64("move-speed", 0, "maximum entity speed per second, unlimited if zero")
+var moveStep = flag.Float64("move-step", 0, "maximum distance between two entity updates, unlimited if zero")
+var moveBounds = flag.String("move-bounds", "", "opposite corners of the world as x,y,z;x,y,z, unbounded if empty")
+var moveReject = flag.Bool("move-reject", false, "drop entity updates breaking the movement rules instead of clamping them")
+var moveKick = flag.Int("move-kick", 0, "movement violations after which a client is kicked, never if zero")
+var ownership = flag.String("ownership", realtime.OwnershipFirstCome, "who gets a requested entity: first_come, timeout or priority")
+var ownershipTimeout = flag.Duration("ownership-timeout", 5*time.Second, "time without updates after which an entity can be taken with -ownership timeout")
+var moderatorKey = flag.String("moderator-key", "", "key of the moderator sessions, no moderators if empty")
+var teams = flag.String("teams", "", "comma separated teams the players of a space are spread over")
+var fog = flag.Bool("fog", false, "hide entities from the other teams")
+var fogRange = flag.Float64("fog-range", 0, "distance within which a team sees the entities of the others with -fog")
+var zones zoneFlags
+var qualityInterval = flag.Duration("quality", 0, "period of the connection quality sent to the clients, disabled if zero")
+
+// parseWaypoints parses points written as x,y,z;x,y,z;...
+func parseWaypoints(s string) ([]realtime.Vec3, error) {
+	var points []realtime.Vec3
+	for _, point := range strings.Split(s, ";") {
+		if point = strings.TrimSpace(point); point == "" {
+			continue
+		}
+		coords := strings.Split(point, ",")
+		if len(coords) != 3 {
+			return nil, fmt.Errorf("waypoint %q: want x,y,z", point)
+		}
+		var v [3]float32
+		for i, c := range coords {
+			f, err := strconv.ParseFloat(strings.TrimSpace(c), 32)
+			if err != nil {
+				return nil, fmt.Errorf("waypoint %q: %v", point, err)
+			}
+			v[i] = float32(f)
+		}
+		points = append(points, realtime.Vec3{X: v[0], Y: v[1], Z: v[2]})
+	}
+	return points, nil
+}
+
+// Environment variable holding the file descriptor of the listener inherited
+// from the process being replaced.
+const listenerFDEnv = "WS_LISTENER_FD"
+
+// handoff waits until the clients of a restarted server left, for at most
+// -handoff or until SIGINT or SIGTERM.
+func handoff(srv *realtime.Server, interrupt <-chan os.Signal) {
+	timeout := time.After(*handoffTimeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for srv.Clients() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return
+		case sig := <-interrupt:
+			if sig != syscall.SIGHUP {
+				return
+			}
+		}
+	}
+}
+
+// inheritedListener returns the listener passed by the process being replaced,
+// or nil if there is none.
+func inheritedListener() (net.Listener, error) {
+	s := os.Getenv(listenerFDEnv)
+	if s == "" {
+		return nil, nil
+	}
+	os.Unsetenv(listenerFDEnv)
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// parseLODBands parses bands written as distance:rate,distance:rate,...
+func parseLODBands(s string) ([]realtime.LODBand, error) {
+	var bands []realtime.LODBand
+	for _, band := range strings.Split(s, ",") {
+		if band = strings.TrimSpace(band); band == "" {
+			continue
+		}
+		parts := strings.Split(band, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("band %q: want distance:rate", band)
+		}
+		distance, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 32)
+		if err != nil {
+			return nil, fmt.Errorf("band %q: %v", band, err)
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("band %q: %v", band, err)
+		}
+		bands = append(bands, realtime.LODBand{Distance: float32(distance), Rate: rate})
+	}
+	sort.Slice(bands, func(i, j int) bool { return bands[i].Distance < bands[j].Distance })
+	return bands, nil
+}
+
+// zoneFlags collects the zones given with -zone.
+type zoneFlags []realtime.Zone
+
+func (f *zoneFlags) String() string {
+	return fmt.Sprint(len(*f), " zones")
+}
+
+// Set parses a zone written as box:id:x,y,z;x,y,z or sphere:id:x,y,z;radius.
+func (f *zoneFlags) Set(s string) error {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("zone %q: want shape:id:coordinates", s)
+	}
+	zone := realtime.Zone{ID: parts[1]}
+	switch parts[0] {
+	case "box":
+		corners, err := parseWaypoints(parts[2])
+		if err != nil {
+			return err
+		}
+		if len(corners) != 2 {
+			return fmt.Errorf("zone %q: want two corners", s)
+		}
+		zone.Min, zone.Max = corners[0], corners[1]
+	case "sphere":
+		i := strings.LastIndex(parts[2], ";")
+		if i < 0 {
+			return fmt.Errorf("zone %q: want x,y,z;radius", s)
+		}
+		centers, err := parseWaypoints(parts[2][:i])
+		if err != nil {
+			return err
+		}
+		radius, err := strconv.ParseFloat(strings.TrimSpace(parts[2][i+1:]), 32)
+		if err != nil || len(centers) != 1 || radius <= 0 {
+			return fmt.Errorf("zone %q: want x,y,z;radius", s)
+		}
+		zone.Center, zone.Radius = centers[0], float32(radius)
+	default:
+		return fmt.Errorf("zone %q: unknown shape %q", s, parts[0])
+	}
+	*f = append(*f, zone)
+	return nil
+}
+
+// splitList splits a comma separated list, nil if empty.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// fogOfWar returns the fog of war of the flags, nil if disabled.
+func fogOfWar() *realtime.FogOfWar {
+	if !*fog {
+		return nil
+	}
+	return &realtime.FogOfWar{Range: float32(*fogRange)}
+}
+
+// movementRules returns the movement rules of the flags for every space, nil
+// if no rule is set.
+func movementRules() (map[string]*realtime.MovementRules, error) {
+	corners, err := parseWaypoints(*moveBounds)
+	if err != nil {
+		return nil, err
+	}
+	if len(corners) != 0 && len(corners) != 2 {
+		return nil, fmt.Errorf("want two corners, got %d", len(corners))
+	}
+	if *moveSpeed == 0 && *moveStep == 0 && len(corners) == 0 {
+		return nil, nil
+	}
+	rules := &realtime.MovementRules{
+		MaxSpeed:  float32(*moveSpeed),
+		MaxStep:   float32(*moveStep),
+		Reject:    *moveReject,
+		KickAfter: *moveKick,
+	}
+	if len(corners) == 2 {
+		rules.Min, rules.Max = corners[0], corners[1]
+	}
+	return map[string]*realtime.MovementRules{realtime.AnySpace: rules}, nil
+}
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.URL)
@@ -26,15 +248,92 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	flag.Var(&zones, "zone", "trigger zone in every space as box:id:x,y,z;x,y,z or sphere:id:x,y,z;radius, repeatable")
 	flag.Parse()
-	hub := newHub()
-	go hub.run()
-	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
+	waypoints, err := parseWaypoints(*botWaypoints)
+	if err != nil {
+		log.Fatal("bot-waypoints: ", err)
+	}
+	switch *ownership {
+	case realtime.OwnershipFirstCome, realtime.OwnershipTimeout, realtime.OwnershipPriority:
+	default:
+		log.Fatal("ownership: unknown policy ", *ownership)
+	}
+	movement, err := movementRules()
+	if err != nil {
+		log.Fatal("move-bounds: ", err)
+	}
+	bands, err := parseLODBands(*lodBands)
+	if err != nil {
+		log.Fatal("lod: ", err)
+	}
+	ln, err := inheritedListener()
+	if err != nil {
+		log.Fatal("inherited listener: ", err)
+	}
+	srv, err := realtime.NewServer(&realtime.Options{
+		Addr:            *addr,
+		Listener:        ln,
+		HistoryWindow:   *historyWindow,
+		TicketTimeout:   *ticketTimeout,
+		ChatDB:          *chatDB,
+		ChatJoinHistory: *chatJoinHistory,
+		LuaDir:          *luaDir,
+		Bots: realtime.BotConfig{
+			Count:     *botCount,
+			Spaces:    splitList(*botSpaces),
+			Path:      *botPath,
+			Waypoints: waypoints,
+			Area:      float32(*botArea),
+			Speed:     float32(*botSpeed),
+			Rate:      *botRate,
+		},
+		UDPAddr:         *udpAddr,
+		QualityInterval: *qualityInterval,
+		DeltaQuantum:    float32(*deltaQuantum),
+		DeltaKeyframe:   *deltaKeyframe,
+		LODBands:        bands,
+		Movement:        movement,
+		Zones:           map[string][]realtime.Zone{realtime.AnySpace: zones},
+		ModeratorKey:    *moderatorKey,
+		Ownership:       realtime.OwnershipPolicy{Policy: *ownership, Timeout: *ownershipTimeout},
+		Teams:           splitList(*teams),
+		FogOfWar:        fogOfWar(),
 	})
-	err := http.ListenAndServe(*addr, nil)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal("NewServer: ", err)
+	}
+	srv.Handle("/", http.HandlerFunc(serveHome))
+	err = srv.Start(context.Background())
+	if err != nil {
+		log.Fatal("Start: ", err)
+	}
+	if *adminAddr != "" {
+		go func() {
+			log.Println("admin: ", http.ListenAndServe(*adminAddr, srv.AdminHandler()))
+		}()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range interrupt {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		// On SIGHUP a new process takes over the listener and this one
+		// serves its clients until they leave.
+		if err := restart(srv); err != nil {
+			log.Println("restart: ", err, ", still serving")
+		} else {
+			log.Println("Restarted, handing off")
+			handoff(srv, interrupt)
+			break
+		}
+	}
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Shutdown: ", err)
 	}
 }
@@ -0,0 +1,174 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"nakama/server"
+)
+
+// Most SpacePresence updates a bot sends per second.
+const maxBotRate = 1000
+
+// Paths bots can move on.
+const (
+	BotPathRandomWalk = "random"
+	BotPathWaypoints  = "waypoints"
+)
+
+// BotConfig describes the bots spawned by the hub.
+type BotConfig struct {
+	// Number of bots in each space.
+	Count int
+
+	// Spaces to spawn bots in.
+	Spaces []string
+
+	// Path of the bots, BotPathRandomWalk or BotPathWaypoints.
+	Path string
+
+	// Points the bots cycle through on the waypoints path. Each bot starts
+	// at a different waypoint.
+	Waypoints []Vec3
+
+	// Half size of the square, centered on the origin, random walks stay in.
+	Area float32
+
+	// Distance moved per second.
+	Speed float32
+
+	// SpacePresence updates sent per second, at most maxBotRate.
+	Rate int
+}
+
+// bot is a server-simulated client owning one entity. Its updates go through
+// the hub like the messages of a real client, and its outbound messages are
+// discarded.
+type bot struct {
+	client   *Client
+	config   *BotConfig
+	position Vec3
+	heading  float64
+	waypoint int
+}
+
+// spawnBots starts the bots of every configured space.
+func (h *Hub) spawnBots(config *BotConfig) {
+	if config.Count <= 0 || config.Rate <= 0 {
+		return
+	}
+	for _, space := range config.Spaces {
+		for i := 0; i < config.Count; i++ {
+			b := &bot{
+				client: &Client{
+					hub:   h,
+					send:  newSendQueue(),
+					lod:   make(map[entityKey]*lodEntry),
+					shown: make(map[entityKey]bool),
+					zones: make(map[string]bool),
+					id:    fmt.Sprintf("%s%s-%d", botIDPrefix, space, i+1),
+					bot:   true,
+					space: space,
+					role:  RolePlayer,
+				},
+				config:  config,
+				heading: rand.Float64() * 2 * math.Pi,
+			}
+			if config.Path == BotPathWaypoints && len(config.Waypoints) > 0 {
+				b.waypoint = i % len(config.Waypoints)
+				b.position = config.Waypoints[b.waypoint]
+			} else {
+				b.position = Vec3{
+					X: (rand.Float32()*2 - 1) * config.Area,
+					Z: (rand.Float32()*2 - 1) * config.Area,
+				}
+			}
+			go b.run()
+		}
+	}
+}
+
+func (b *bot) run() {
+	if !b.client.hub.registerClient(b.client) {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		for range b.client.send.ready {
+			if _, ok := b.client.send.take(); !ok {
+				break
+			}
+		}
+		close(stopped)
+	}()
+
+	period := time.Second / time.Duration(b.config.Rate)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+			b.move(float32(period.Seconds()) * b.config.Speed)
+			data, err := marshal(&server.Envelope{Payload: &server.Envelope_SpacePresence{
+				SpacePresence: &server.SpacePresence{Changes: []*server.Entity{{
+					Id:       b.client.id,
+					UserId:   b.client.id,
+					Position: b.position.V3(),
+				}}},
+			}})
+			if err != nil {
+				continue
+			}
+			if !b.client.hub.broadcastMessage(&MessageEnvelope{fromClient: b.client.id, sender: b.client, data: data, receivedAt: time.Now()}) {
+				return
+			}
+		}
+	}
+}
+
+// move advances the bot by distance along its path.
+func (b *bot) move(distance float32) {
+	if b.config.Path == BotPathWaypoints && len(b.config.Waypoints) > 0 {
+		target := b.config.Waypoints[b.waypoint]
+		left := target.sub(b.position).length()
+		if left <= distance {
+			b.position = target
+			b.waypoint = (b.waypoint + 1) % len(b.config.Waypoints)
+			return
+		}
+		b.position = b.position.lerp(target, distance/left)
+		return
+	}
+
+	b.heading += (rand.Float64() - 0.5) * math.Pi / 4
+	b.position.X += distance * float32(math.Cos(b.heading))
+	b.position.Z += distance * float32(math.Sin(b.heading))
+	// Turn back at the edges of the area.
+	area := b.config.Area
+	if b.position.X < -area || b.position.X > area {
+		b.position.X = clamp(b.position.X, -area, area)
+		b.heading = math.Pi - b.heading
+	}
+	if b.position.Z < -area || b.position.Z > area {
+		b.position.Z = clamp(b.position.Z, -area, area)
+		b.heading = -b.heading
+	}
+}
+
+func clamp(v, min, max float32) float32 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,343 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"nakama/server"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// Rpc ids of the chat. Clients send chat_join, chat_leave, chat_send and
+	// chat_history; the server answers each on the same collation id and
+	// sends chat_message to the members of a channel for every new message.
+	rpcChatJoin    = "chat_join"
+	rpcChatLeave   = "chat_leave"
+	rpcChatSend    = "chat_send"
+	rpcChatHistory = "chat_history"
+	rpcChatMessage = "chat_message"
+
+	// Most messages returned by one chat_history request.
+	maxChatPage = 100
+
+	// Most pending reads and writes of the chat store. Requests beyond are
+	// refused rather than blocking the hub.
+	maxChatOps = 256
+)
+
+// chatMessage is a stored chat message, and the json payload of a
+// chat_message rpc.
+type chatMessage struct {
+	ID        string `json:"id"`
+	Channel   string `json:"channel"`
+	SenderID  string `json:"sender_id"`
+	Timestamp int64  `json:"timestamp"`
+	Content   string `json:"content"`
+}
+
+// chatRequest is the json payload of the chat rpcs sent by clients.
+// Content is only used by chat_send, Cursor and Limit by chat_history.
+type chatRequest struct {
+	Channel string `json:"channel"`
+	Content string `json:"content"`
+	Cursor  string `json:"cursor"`
+	Limit   int    `json:"limit"`
+}
+
+// chatPage is the json payload of the answers to chat_join and chat_history.
+// Messages are newest first. Cursor is passed to chat_history to get the
+// older messages, it is empty when there are none left.
+type chatPage struct {
+	Channel  string         `json:"channel"`
+	Messages []*chatMessage `json:"messages"`
+	Cursor   string         `json:"cursor"`
+}
+
+var errChatBusy = errors.New("chat busy")
+
+// ChatStore keeps the chat messages on disk, one bucket per channel keyed by
+// the message sequence number. Reads and writes run on a goroutine of their
+// own so the hub never waits for the disk, and the ones pending together are
+// committed in one transaction.
+type ChatStore struct {
+	db   *bolt.DB
+	ops  chan *chatOp
+	done chan struct{}
+}
+
+// chatOp is a read or write of the store. reply is called on the store
+// goroutine once the transaction running it is committed.
+type chatOp struct {
+	run   func(tx *bolt.Tx) error
+	reply func(err error)
+}
+
+func openChatStore(path string) (*ChatStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &ChatStore{
+		db:   db,
+		ops:  make(chan *chatOp, maxChatOps),
+		done: make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Close runs the pending operations and closes the database. It must not be
+// called while operations are queued from another goroutine.
+func (s *ChatStore) Close() error {
+	close(s.ops)
+	<-s.done
+	return s.db.Close()
+}
+
+func (s *ChatStore) run() {
+	defer close(s.done)
+	for op := range s.ops {
+		batch := []*chatOp{op}
+	pending:
+		for len(batch) < maxChatOps {
+			select {
+			case op, ok := <-s.ops:
+				if !ok {
+					break pending
+				}
+				batch = append(batch, op)
+			default:
+				break pending
+			}
+		}
+		s.commit(batch)
+	}
+}
+
+// commit runs a batch of operations in one transaction. An operation failing
+// does not fail the others.
+func (s *ChatStore) commit(batch []*chatOp) {
+	errs := make([]error, len(batch))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for i, op := range batch {
+			errs[i] = op.run(tx)
+		}
+		return nil
+	})
+	for i, op := range batch {
+		if err != nil {
+			errs[i] = err
+		}
+		op.reply(errs[i])
+	}
+}
+
+// queue adds an operation, or reports errChatBusy if too many are pending.
+func (s *ChatStore) queue(run func(tx *bolt.Tx) error, reply func(err error)) error {
+	select {
+	case s.ops <- &chatOp{run: run, reply: reply}:
+		return nil
+	default:
+		return errChatBusy
+	}
+}
+
+// append stores msg in its channel, sets its id and calls reply.
+func (s *ChatStore) append(msg *chatMessage, reply func(err error)) error {
+	return s.queue(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(msg.Channel))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		msg.ID = strconv.FormatUint(seq, 10)
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return b.Put(sequenceKey(seq), data)
+	}, reply)
+}
+
+// page reads up to limit messages of the channel older than the message id
+// cursor, newest first, and passes them to reply. An empty cursor starts from
+// the newest message.
+func (s *ChatStore) page(channel, cursor string, limit int, reply func(page *chatPage, err error)) error {
+	page := &chatPage{Channel: channel, Messages: []*chatMessage{}}
+	return s.queue(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(channel))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if cursor == "" {
+			k, v = c.Last()
+		} else {
+			seq, err := strconv.ParseUint(cursor, 10, 64)
+			if err != nil {
+				return err
+			}
+			if k, _ = c.Seek(sequenceKey(seq)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil && len(page.Messages) < limit; k, v = c.Prev() {
+			msg := &chatMessage{}
+			if err := json.Unmarshal(v, msg); err != nil {
+				return err
+			}
+			page.Messages = append(page.Messages, msg)
+		}
+		if k != nil && len(page.Messages) > 0 {
+			page.Cursor = page.Messages[len(page.Messages)-1].ID
+		}
+		return nil
+	}, func(err error) {
+		reply(page, err)
+	})
+}
+
+func sequenceKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+func (h *Hub) chatRequest(message *MessageEnvelope, e *server.Envelope) (*chatRequest, bool) {
+	if h.chat == nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "chat unavailable"))
+		return nil, false
+	}
+	req := &chatRequest{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return nil, false
+	}
+	if req.Channel == "" {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, "missing channel"))
+		return nil, false
+	}
+	return req, true
+}
+
+// sendChatPage sends the sender a page of the channel once it is read.
+func (h *Hub) sendChatPage(message *MessageEnvelope, e *server.Envelope, channel, cursor string, limit int) {
+	err := h.chat.page(channel, cursor, limit, func(page *chatPage, err error) {
+		if err != nil {
+			h.send(message.sender, errorEnvelope(e.CollationId, errCodeInternal, err.Error()))
+			return
+		}
+		h.send(message.sender, rpcEnvelope(e.GetRpc().Id, e.CollationId, page))
+	})
+	if err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeInternal, err.Error()))
+	}
+}
+
+// joinChat handles a chat_join rpc. The answer holds the latest messages of
+// the channel.
+func (h *Hub) joinChat(message *MessageEnvelope, e *server.Envelope) {
+	req, ok := h.chatRequest(message, e)
+	if !ok {
+		return
+	}
+	members, ok := h.channels[req.Channel]
+	if !ok {
+		members = make(map[*Client]bool)
+		h.channels[req.Channel] = members
+	}
+	members[message.sender] = true
+	h.sendChatPage(message, e, req.Channel, "", h.chatJoinHistory)
+}
+
+// leaveChat handles a chat_leave rpc.
+func (h *Hub) leaveChat(message *MessageEnvelope, e *server.Envelope) {
+	req, ok := h.chatRequest(message, e)
+	if !ok {
+		return
+	}
+	h.leaveChannel(req.Channel, message.sender)
+	h.send(message.sender, rpcEnvelope(rpcChatLeave, e.CollationId, req))
+}
+
+func (h *Hub) leaveChannel(channel string, client *Client) {
+	if members, ok := h.channels[channel]; ok {
+		delete(members, client)
+		if len(members) == 0 {
+			delete(h.channels, channel)
+		}
+	}
+}
+
+// sendChat handles a chat_send rpc. The message is stored, then sent to every
+// member of the channel, the sender included. The members are the ones of
+// the channel when the message was sent.
+func (h *Hub) sendChat(message *MessageEnvelope, e *server.Envelope) {
+	req, ok := h.chatRequest(message, e)
+	if !ok {
+		return
+	}
+	if !h.channels[req.Channel][message.sender] {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, "not a member of channel "+req.Channel))
+		return
+	}
+	msg := &chatMessage{
+		Channel:   req.Channel,
+		SenderID:  message.sender.id,
+		Timestamp: unixMillis(time.Now()),
+		Content:   req.Content,
+	}
+	members := make([]*Client, 0, len(h.channels[req.Channel]))
+	for member := range h.channels[req.Channel] {
+		members = append(members, member)
+	}
+	err := h.chat.append(msg, func(err error) {
+		if err != nil {
+			h.send(message.sender, errorEnvelope(e.CollationId, errCodeInternal, err.Error()))
+			return
+		}
+		for _, member := range members {
+			collationID := ""
+			if member == message.sender {
+				collationID = e.CollationId
+			}
+			h.sendOn(member, laneReliable, rpcEnvelope(rpcChatMessage, collationID, msg))
+		}
+	})
+	if err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeInternal, err.Error()))
+	}
+}
+
+// chatHistory handles a chat_history rpc.
+func (h *Hub) chatHistory(message *MessageEnvelope, e *server.Envelope) {
+	req, ok := h.chatRequest(message, e)
+	if !ok {
+		return
+	}
+	if req.Limit <= 0 || req.Limit > maxChatPage {
+		req.Limit = maxChatPage
+	}
+	if req.Cursor != "" {
+		if _, err := strconv.ParseUint(req.Cursor, 10, 64); err != nil {
+			h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, "bad cursor"))
+			return
+		}
+	}
+	h.sendChatPage(message, e, req.Channel, req.Cursor, req.Limit)
+}
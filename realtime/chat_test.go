@@ -0,0 +1,88 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openTestChat opens a chat store in a temporary directory holding count
+// messages in channel c, with ids 1 to count.
+func openTestChat(t *testing.T, count int) *ChatStore {
+	s, err := openChatStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for i := 0; i < count; i++ {
+		done := make(chan error, 1)
+		if err := s.append(&chatMessage{Channel: "c", Content: "hello"}, func(err error) { done <- err }); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestChatPage(t *testing.T) {
+	s := openTestChat(t, 5)
+	tests := []struct {
+		name       string
+		channel    string
+		cursor     string
+		limit      int
+		wantIDs    []string
+		wantCursor string
+	}{
+		{"newest", "c", "", 2, []string{"5", "4"}, "4"},
+		{"from a cursor", "c", "4", 2, []string{"3", "2"}, "2"},
+		{"last page", "c", "2", 2, []string{"1"}, ""},
+		{"exact last page", "c", "3", 2, []string{"2", "1"}, ""},
+		{"everything", "c", "", 10, []string{"5", "4", "3", "2", "1"}, ""},
+		{"cursor past the newest", "c", "9", 1, []string{"5"}, "5"},
+		{"nothing older", "c", "1", 2, []string{}, ""},
+		{"unknown channel", "d", "", 2, []string{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan *chatPage, 1)
+			err := s.page(tt.channel, tt.cursor, tt.limit, func(page *chatPage, err error) {
+				if err != nil {
+					t.Error(err)
+				}
+				done <- page
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := <-done
+			ids := []string{}
+			for _, msg := range page.Messages {
+				ids = append(ids, msg.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("ids %v, want %v", ids, tt.wantIDs)
+			}
+			if page.Cursor != tt.wantCursor {
+				t.Errorf("cursor %q, want %q", page.Cursor, tt.wantCursor)
+			}
+		})
+	}
+}
+
+func TestChatPageBadCursor(t *testing.T) {
+	s := openTestChat(t, 1)
+	done := make(chan error, 1)
+	if err := s.page("c", "x", 1, func(page *chatPage, err error) { done <- err }); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Error("no error for a cursor that is not a message id")
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	// "bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait = 60 * time.Second
+
+	// Maximum message size allowed from peer.
+	maxMessageSize = 512
+)
+
+var (
+	newline = []byte{'\n'}
+	space   = []byte{' '}
+)
+
+// Client is a middleman between the connection and the hub.
+type Client struct {
+	hub *Hub
+
+	// The connection to the peer.
+	transport Transport
+
+	// Outbound messages.
+	send *sendQueue
+
+	id string
+
+	// Whether the client is a bot spawned by the hub.
+	bot bool
+
+	// Space the client plays in. Messages are only relayed between clients
+	// of the same space.
+	space string
+
+	// Subprotocol negotiated for the connection, which selects the encoding
+	// of the envelopes.
+	encoding string
+
+	// Entities last sent to the client, nil unless it asked for delta
+	// updates.
+	delta *deltaState
+
+	// Entity updates throttled by distance, by entity.
+	lod map[entityKey]*lodEntry
+
+	// Role of the client in its space.
+	role string
+
+	// Team of the client in its space, empty if it has none.
+	team string
+
+	// Priority of the client for entities under OwnershipPriority.
+	authority int
+
+	// Entities of other teams the client was sent under fog of war, told
+	// when they go under the fog.
+	shown map[entityKey]bool
+
+	// Zones the client gets the events of.
+	zones map[string]bool
+
+	// Number of updates that broke the movement rules of the space.
+	violations int
+
+	// Round trip times of the pings.
+	quality connQuality
+
+	// The udp session of the client, nil if it did not bind one.
+	udp *udpPeer
+
+	// Websocket close code and reason sent once the hub closed send.
+	closeCode   int
+	closeReason string
+}
+
+// newClient creates a client for the peer of the request, identified by
+// the id and space query parameters, with a role checked by sessionRole.
+func newClient(hub *Hub, transport Transport, encoding, role string, r *http.Request) *Client {
+	client := &Client{hub: hub, transport: transport, send: newSendQueue(), lod: make(map[entityKey]*lodEntry), shown: make(map[entityKey]bool), zones: make(map[string]bool), encoding: encoding, role: role}
+	if role == RoleModerator {
+		client.authority = 1
+	}
+	id, ok := r.URL.Query()["id"]
+	if ok {
+		client.id = id[0]
+	}
+	client.space = r.URL.Query().Get("space")
+	if t, ok := transport.(rttTransport); ok {
+		t.OnRTT(client.quality.record)
+	}
+	return client
+}
+
+// ID returns the id the client connected with.
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Space returns the space the client plays in.
+func (c *Client) Space() string {
+	return c.space
+}
+
+// readPump pumps messages from the connection to the hub.
+//
+// The application runs readPump in a per-connection goroutine. The application
+// ensures that there is at most one reader on a connection by executing all
+// reads from this goroutine. The connection is closed by writePump, once the
+// hub closed the send queue and the last messages are flushed.
+func (c *Client) readPump() {
+	defer c.hub.unregisterClient(c)
+	for {
+		message, err := c.transport.Read()
+		if err != nil {
+			break
+		}
+		// message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		receivedAt := time.Now()
+		data := c.decodeInbound(message)
+		if c.role == RoleSpectator && !isRPC(data) {
+			// Spectators only call rpcs, their game messages are
+			// dropped before they reach the hub.
+			c.hub.send(c, errorEnvelope("", errCodeRejected, "spectators are receive-only"))
+			continue
+		}
+		if !c.hub.broadcastMessage(&MessageEnvelope{fromClient: c.id, sender: c, data: data, receivedAt: receivedAt}) {
+			break
+		}
+	}
+}
+
+// writePump pumps messages from the hub to the connection.
+//
+// A goroutine running writePump is started for each connection. The
+// application ensures that there is at most one writer to a connection by
+// executing all writes from this goroutine.
+func (c *Client) writePump() {
+	// Pings keep the connection alive and sample its round trip time.
+	ticker := time.NewTicker(c.hub.pingPeriod())
+	defer func() {
+		ticker.Stop()
+		c.transport.Close()
+		c.hub.pumps.Done()
+	}()
+	for {
+		select {
+		case <-c.send.ready:
+			// Control messages go first, then reliable ones, then the
+			// newest entity state.
+			messages, ok := c.send.take()
+			if len(messages) > 0 {
+				if err := c.transport.Write(messages); err != nil {
+					return
+				}
+			}
+			if !ok {
+				// The hub closed the queue.
+				fmt.Println("connection closed")
+				c.transport.WriteClose(c.closeCode, c.closeReason)
+				return
+			}
+		case <-ticker.C:
+			if err := c.transport.Ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveWs handles websocket requests from the peer.
+func (s *Server) serveWs(w http.ResponseWriter, r *http.Request) {
+	if s.draining() {
+		http.Error(w, "Server shutting down", 503)
+		return
+	}
+	hub := s.hub
+	role, err := hub.sessionRole(r)
+	if err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	client := newClient(hub, newWSTransport(conn), conn.Subprotocol(), role, r)
+	if !client.hub.registerClient(client) {
+		conn.Close()
+		return
+	}
+
+	// Allow collection of memory referenced by the caller by doing all work in
+	// new goroutines.
+	go client.writePump()
+	go client.readPump()
+}
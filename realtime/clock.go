@@ -0,0 +1,60 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/json"
+	"time"
+
+	"nakama/server"
+)
+
+const (
+	// Rpc id of the clock synchronization exchange.
+	rpcClockSync = "clock_sync"
+
+	// Rpc id of the stamp sent ahead of the SpacePresence updates relayed
+	// to a client.
+	rpcServerTick = "server_tick"
+
+	// Duration of one hub tick.
+	tickPeriod = 50 * time.Millisecond
+)
+
+// clockSync is the json payload of a clock_sync rpc. The client fills in
+// ClientTime with its local time, the server answers with the time the
+// request was read (ServerRecv) and the time the answer was queued
+// (ServerSend). All times are unix milliseconds.
+type clockSync struct {
+	ClientTime int64 `json:"client_time"`
+	ServerRecv int64 `json:"server_recv"`
+	ServerSend int64 `json:"server_send"`
+	Tick       int64 `json:"tick"`
+}
+
+// serverTick is the json payload of a server_tick rpc. The SpacePresence
+// updates following it, up to the next server_tick, were relayed at
+// ServerTime (unix milliseconds) during Tick.
+type serverTick struct {
+	ServerTime int64 `json:"server_time"`
+	Tick       int64 `json:"tick"`
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// answerClockSync replies to a clock_sync rpc.
+func (h *Hub) answerClockSync(message *MessageEnvelope, e *server.Envelope) {
+	req := &clockSync{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return
+	}
+	req.ServerRecv = unixMillis(message.receivedAt)
+	req.Tick = h.tick
+	req.ServerSend = unixMillis(time.Now())
+	h.send(message.sender, rpcEnvelope(rpcClockSync, e.CollationId, req))
+}
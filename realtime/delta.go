@@ -0,0 +1,275 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"nakama/server"
+)
+
+const (
+	// Rpc id a client sends to get entity_delta rpcs instead of
+	// SpacePresence envelopes.
+	rpcDeltaEnable = "delta_enable"
+
+	// Rpc id a client sends when it lost track of the entities. The next
+	// update of each entity is then sent in full.
+	rpcDeltaResync = "delta_resync"
+
+	// Rpc id a client sends to acknowledge entity_delta rpcs.
+	rpcDeltaAck = "delta_ack"
+
+	// Rpc id of the entity updates sent to delta clients.
+	rpcEntityDelta = "entity_delta"
+
+	// Most updates a client may leave unacknowledged. Deltas are not based
+	// on older ones.
+	maxDeltaUnacked = 256
+)
+
+// deltaConfig is the json payload of the delta_enable reply. Positions are
+// sent as multiples of Quantum, or as is if Quantum is zero.
+type deltaConfig struct {
+	Quantum    float32 `json:"quantum"`
+	KeyframeMs int64   `json:"keyframe_ms"`
+}
+
+// entityDelta is the json payload of an entity_delta rpc, the counterpart of a
+// SpacePresence. Seq numbers the updates sent to the client from 1, the
+// client acknowledges them with delta_ack.
+type entityDelta struct {
+	Seq        int64          `json:"seq"`
+	ServerTime int64          `json:"server_time"`
+	Tick       int64          `json:"tick"`
+	Changes    []*deltaEntity `json:"changes"`
+}
+
+// deltaEntity holds the fields of an entity that differ from the update Base,
+// the newest update of the entity the client acknowledged. Full is set, and
+// Base is zero, when every field is present.
+type deltaEntity struct {
+	ID     string   `json:"id"`
+	Base   int64    `json:"base,omitempty"`
+	Full   bool     `json:"full,omitempty"`
+	UserID string   `json:"user_id,omitempty"`
+	X      *float64 `json:"x,omitempty"`
+	Y      *float64 `json:"y,omitempty"`
+	Z      *float64 `json:"z,omitempty"`
+}
+
+// deltaAck is the json payload of a delta_ack rpc.
+type deltaAck struct {
+	Seqs []int64 `json:"seqs"`
+}
+
+// deltaState holds what was sent to a delta client. Updates may be dropped on
+// the way, so deltas are only based on updates the client acknowledged.
+type deltaState struct {
+	seq      int64
+	entities map[entityKey]*deltaEntityState
+
+	// Updates not acknowledged yet by seq, and their seqs oldest first.
+	sent  map[int64]*deltaSnapshot
+	order []int64
+}
+
+// deltaEntityState is what a delta client has of an entity.
+type deltaEntityState struct {
+	// Newest update the client acknowledged, nil if none.
+	acked *deltaSnapshot
+
+	// When the entity was last sent in full.
+	keyframe time.Time
+
+	// Number of updates of the entity not acknowledged yet.
+	unacked int
+}
+
+// deltaSnapshot is an entity as sent in an update.
+type deltaSnapshot struct {
+	seq      int64
+	entity   entityKey
+	userID   string
+	position [3]float64
+}
+
+func newDeltaState() *deltaState {
+	return &deltaState{
+		entities: make(map[entityKey]*deltaEntityState),
+		sent:     make(map[int64]*deltaSnapshot),
+	}
+}
+
+// enableDelta switches the sender to entity_delta rpcs.
+func (h *Hub) enableDelta(message *MessageEnvelope, e *server.Envelope) {
+	if message.sender.delta == nil {
+		message.sender.delta = newDeltaState()
+	}
+	h.send(message.sender, rpcEnvelope(rpcDeltaEnable, e.CollationId, &deltaConfig{
+		Quantum:    h.deltaQuantum,
+		KeyframeMs: int64(h.deltaKeyframe / time.Millisecond),
+	}))
+}
+
+// resyncDelta forgets the entities sent to the sender.
+func (h *Hub) resyncDelta(message *MessageEnvelope, e *server.Envelope) {
+	if message.sender.delta == nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "delta updates not enabled"))
+		return
+	}
+	seq := message.sender.delta.seq
+	message.sender.delta = newDeltaState()
+	message.sender.delta.seq = seq
+	h.send(message.sender, rpcEnvelope(rpcDeltaResync, e.CollationId, struct{}{}))
+}
+
+// ackDelta handles a delta_ack rpc. It is not answered.
+func (h *Hub) ackDelta(message *MessageEnvelope, e *server.Envelope) {
+	d := message.sender.delta
+	if d == nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "delta updates not enabled"))
+		return
+	}
+	req := &deltaAck{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return
+	}
+	for _, seq := range req.Seqs {
+		d.ack(seq)
+	}
+}
+
+// ack makes the update seq the base of the next deltas of its entity, unless
+// a newer one was acknowledged. Older updates of the entity are forgotten.
+func (d *deltaState) ack(seq int64) {
+	snapshot, ok := d.sent[seq]
+	if !ok {
+		return
+	}
+	st := d.entities[snapshot.entity]
+	for s, other := range d.sent {
+		if other.entity == snapshot.entity && s <= seq {
+			delete(d.sent, s)
+			st.unacked--
+		}
+	}
+	if st.acked == nil || st.acked.seq < seq {
+		st.acked = snapshot
+	}
+}
+
+// record keeps an update sent to the client until it is acknowledged. The
+// oldest updates are forgotten beyond maxDeltaUnacked.
+func (d *deltaState) record(snapshot *deltaSnapshot) {
+	d.sent[snapshot.seq] = snapshot
+	d.order = append(d.order, snapshot.seq)
+	d.entities[snapshot.entity].unacked++
+	for len(d.sent) > maxDeltaUnacked || (len(d.order) > 0 && d.sent[d.order[0]] == nil) {
+		if old, ok := d.sent[d.order[0]]; ok {
+			delete(d.sent, old.seq)
+			d.entities[old.entity].unacked--
+		}
+		d.order = d.order[1:]
+	}
+}
+
+// forget drops an entity, so it is sent in full if the id comes back.
+func (d *deltaState) forget(key entityKey) {
+	delete(d.entities, key)
+	for seq, snapshot := range d.sent {
+		if snapshot.entity == key {
+			delete(d.sent, seq)
+		}
+	}
+}
+
+// quantize returns v in multiples of the quantum.
+func (h *Hub) quantize(v float32) float64 {
+	if h.deltaQuantum <= 0 {
+		return float64(v)
+	}
+	return math.Floor(float64(v/h.deltaQuantum) + 0.5)
+}
+
+// sendDelta sends the client an entity_delta for each entity of sp, relayed
+// in space, with the fields that differ from the update the client
+// acknowledged last. Entities without an acknowledged update, or not sent in
+// full for deltaKeyframe, are
+// sent in full. An entity is skipped only if it equals the acknowledged
+// update and no other update of it is on the way. The deltas go over udp if
+// the client bound a udp session, else on its state lane, as a lost delta is
+// replaced by the next one.
+func (h *Hub) sendDelta(client *Client, space string, sp *server.SpacePresence, tick *serverTick, now time.Time) {
+	for _, entity := range sp.Changes {
+		seq, change, ok := h.nextDelta(client.delta, space, entity, now)
+		if !ok {
+			continue
+		}
+		e := rpcEnvelope(rpcEntityDelta, "", &entityDelta{
+			Seq: seq, ServerTime: tick.ServerTime, Tick: tick.Tick, Changes: []*deltaEntity{change},
+		})
+		if data, err := marshal(e); err == nil && h.sendUDP(client, tick, data) {
+			continue
+		}
+		if data, ok := encodeFor(client, e); ok {
+			client.send.pushState(entityKey{space, entity.Id}, nil, data)
+		}
+	}
+}
+
+// nextDelta returns the delta of an entity for a client and its seq, and
+// records it as sent. It reports false if the client needs no update.
+func (h *Hub) nextDelta(d *deltaState, space string, entity *server.Entity, now time.Time) (int64, *deltaEntity, bool) {
+	snapshot := &deltaSnapshot{entity: entityKey{space, entity.Id}, userID: entity.UserId}
+	if p := entity.Position; p != nil {
+		snapshot.position = [3]float64{h.quantize(p.X), h.quantize(p.Y), h.quantize(p.Z)}
+	}
+	st, ok := d.entities[snapshot.entity]
+	if !ok {
+		st = &deltaEntityState{}
+		d.entities[snapshot.entity] = st
+	}
+	change := &deltaEntity{ID: entity.Id}
+	if st.acked == nil || (h.deltaKeyframe > 0 && now.Sub(st.keyframe) >= h.deltaKeyframe) {
+		st.keyframe = now
+		position := snapshot.position
+		change.Full, change.UserID = true, entity.UserId
+		change.X, change.Y, change.Z = &position[0], &position[1], &position[2]
+	} else {
+		base := st.acked
+		changed := false
+		if snapshot.userID != base.userID {
+			change.UserID, changed = snapshot.userID, true
+		}
+		axes := [3]**float64{&change.X, &change.Y, &change.Z}
+		for i := range snapshot.position {
+			if snapshot.position[i] != base.position[i] {
+				v := snapshot.position[i]
+				*axes[i], changed = &v, true
+			}
+		}
+		if !changed && st.unacked == 0 {
+			return 0, nil, false
+		}
+		change.Base = base.seq
+	}
+	d.seq++
+	snapshot.seq = d.seq
+	d.record(snapshot)
+	return d.seq, change, true
+}
+
+// forgetDelta drops a released entity from the delta state of the clients.
+func (h *Hub) forgetDelta(key entityKey) {
+	for client := range h.clients {
+		if client.delta != nil {
+			client.delta.forget(key)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"nakama/server"
+)
+
+// deltaStep updates the entity to x, or acknowledges the seqs in ack, after
+// the time elapsed. want is the delta sent for an update, empty if none.
+type deltaStep struct {
+	after time.Duration
+	ack   []int64
+	x     float32
+	want  string
+}
+
+func describeDelta(seq int64, change *deltaEntity) string {
+	x := "-"
+	if change.X != nil {
+		x = fmt.Sprint(*change.X)
+	}
+	return fmt.Sprintf("seq=%d base=%d full=%v x=%s", seq, change.Base, change.Full, x)
+}
+
+func TestNextDelta(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []deltaStep
+	}{
+		{"full until acknowledged", []deltaStep{
+			{x: 1, want: "seq=1 base=0 full=true x=1"},
+			{x: 2, want: "seq=2 base=0 full=true x=2"},
+		}},
+		{"delta from the acknowledged update", []deltaStep{
+			{x: 1, want: "seq=1 base=0 full=true x=1"},
+			{ack: []int64{1}},
+			{x: 2, want: "seq=2 base=1 full=false x=2"},
+		}},
+		{"lost delta sent again", []deltaStep{
+			{x: 1, want: "seq=1 base=0 full=true x=1"},
+			{ack: []int64{1}},
+			{x: 2, want: "seq=2 base=1 full=false x=2"},
+			{x: 2, want: "seq=3 base=1 full=false x=2"},
+			{ack: []int64{3}},
+			{x: 2},
+		}},
+		{"skipped when acknowledged", []deltaStep{
+			{x: 1, want: "seq=1 base=0 full=true x=1"},
+			{ack: []int64{1}},
+			{x: 1},
+		}},
+		{"back to the acknowledged update", []deltaStep{
+			{x: 1, want: "seq=1 base=0 full=true x=1"},
+			{ack: []int64{1}},
+			{x: 2, want: "seq=2 base=1 full=false x=2"},
+			{x: 1, want: "seq=3 base=1 full=false x=-"},
+		}},
+		{"older acknowledgement ignored", []deltaStep{
+			{x: 1, want: "seq=1 base=0 full=true x=1"},
+			{x: 2, want: "seq=2 base=0 full=true x=2"},
+			{ack: []int64{2, 1}},
+			{x: 3, want: "seq=3 base=2 full=false x=3"},
+		}},
+		{"unknown acknowledgement ignored", []deltaStep{
+			{x: 1, want: "seq=1 base=0 full=true x=1"},
+			{ack: []int64{7}},
+			{x: 1, want: "seq=2 base=0 full=true x=1"},
+		}},
+		{"keyframe", []deltaStep{
+			{x: 1, want: "seq=1 base=0 full=true x=1"},
+			{ack: []int64{1}},
+			{after: 2 * time.Second, x: 2, want: "seq=2 base=0 full=true x=2"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Hub{deltaKeyframe: time.Second}
+			d := newDeltaState()
+			now := time.Now()
+			for i, step := range tt.steps {
+				now = now.Add(step.after)
+				if step.ack != nil {
+					for _, seq := range step.ack {
+						d.ack(seq)
+					}
+					continue
+				}
+				entity := &server.Entity{Id: "e", UserId: "u", Position: &server.V3{X: step.x}}
+				var got string
+				if seq, change, ok := h.nextDelta(d, "s", entity, now); ok {
+					got = describeDelta(seq, change)
+				}
+				if got != step.want {
+					t.Errorf("step %d: got %q, want %q", i, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeltaUnackedLimit(t *testing.T) {
+	h := &Hub{}
+	d := newDeltaState()
+	now := time.Now()
+	for i := 0; i < maxDeltaUnacked+10; i++ {
+		entity := &server.Entity{Id: fmt.Sprint("e", i%3), Position: &server.V3{X: float32(i)}}
+		h.nextDelta(d, "s", entity, now)
+	}
+	if len(d.sent) != maxDeltaUnacked {
+		t.Errorf("%d updates kept, want %d", len(d.sent), maxDeltaUnacked)
+	}
+	unacked := 0
+	for _, st := range d.entities {
+		unacked += st.unacked
+	}
+	if unacked != len(d.sent) {
+		t.Errorf("entities count %d unacked updates, want %d", unacked, len(d.sent))
+	}
+}
+
+func TestSendDelta(t *testing.T) {
+	h := &Hub{}
+	client := &Client{send: newSendQueue(), delta: newDeltaState()}
+	sp := &server.SpacePresence{Changes: []*server.Entity{
+		{Id: "a", Position: &server.V3{X: 1}},
+		{Id: "b", Position: &server.V3{X: 2}},
+	}}
+	now := time.Now()
+	tick := &serverTick{ServerTime: unixMillis(now), Tick: 1}
+	h.sendDelta(client, "s", sp, tick, now)
+	h.sendDelta(client, "s", sp, tick, now)
+	// Unacknowledged entities are sent in full again, replacing the update
+	// of the entity waiting on the state lane.
+	if n := client.send.len(); n != 2 {
+		t.Errorf("%d updates queued, want 2", n)
+	}
+	if client.delta.seq != 4 {
+		t.Errorf("seq %d, want 4", client.delta.seq)
+	}
+	client.send.take()
+	for seq := int64(1); seq <= 4; seq++ {
+		client.delta.ack(seq)
+	}
+	h.sendDelta(client, "s", sp, tick, now)
+	if n := client.send.len(); n != 0 {
+		t.Errorf("%d updates queued for acknowledged entities, want 0", n)
+	}
+}
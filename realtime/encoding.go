@@ -0,0 +1,75 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"bytes"
+	"fmt"
+
+	"nakama/server"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// WebSocket subprotocols selecting how envelopes are encoded on a
+// connection. Clients that negotiate none get protobuf.
+const (
+	subprotocolProtobuf = "nakama.protobuf"
+	subprotocolJSON     = "nakama.json"
+)
+
+var jsonMarshaler = &jsonpb.Marshaler{OrigName: true}
+
+// decodeInbound converts a message read from the client to the protobuf
+// encoding the hub works with. Messages that are not envelopes, including
+// json without a payload, are returned untouched.
+func (c *Client) decodeInbound(data []byte) []byte {
+	if c.encoding != subprotocolJSON {
+		return data
+	}
+	e := &server.Envelope{}
+	if err := jsonpb.Unmarshal(bytes.NewReader(data), e); err != nil || e.Payload == nil {
+		return data
+	}
+	pb, err := proto.Marshal(e)
+	if err != nil {
+		return data
+	}
+	return pb
+}
+
+// encodeJSON converts a protobuf envelope to json. Messages that are not
+// envelopes are returned untouched.
+func encodeJSON(data []byte) []byte {
+	e := &server.Envelope{}
+	if err := proto.Unmarshal(data, e); err != nil {
+		return data
+	}
+	s, err := jsonMarshaler.MarshalToString(e)
+	if err != nil {
+		fmt.Println("json marshal error: ", err)
+		return data
+	}
+	return []byte(s)
+}
+
+// frame is an outbound protobuf message, converted at most once to json for
+// all the json recipients.
+type frame struct {
+	data []byte
+	json []byte
+}
+
+// dataFor returns the frame in the encoding of the client.
+func (f *frame) dataFor(client *Client) []byte {
+	if client.encoding != subprotocolJSON {
+		return f.data
+	}
+	if f.json == nil {
+		f.json = encodeJSON(f.data)
+	}
+	return f.json
+}
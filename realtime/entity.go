@@ -0,0 +1,134 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"nakama/server"
+
+	"github.com/gorilla/websocket"
+)
+
+// Error codes sent back to a client in a server.Error envelope.
+const (
+	errCodeBadInput       = 3
+	errCodeRuntime        = 4
+	errCodeRejected       = 5
+	errCodeInternal       = 6
+	errCodeEntityNotOwned = 100
+)
+
+// Prefix of the ids of the bots spawned by the hub. Other clients may not
+// use it.
+const botIDPrefix = "bot-"
+
+// Close reason sent to a client replaced by a newer connection with its id.
+const replacedReason = "replaced by a new connection"
+
+// entityKey identifies an entity. Entity ids are picked by the clients and
+// only unique within a space: every match space may have its own "ball".
+type entityKey struct {
+	space string
+	id    string
+}
+
+// checkID refuses clients without an id, and clients other than bots with an
+// id starting with botIDPrefix.
+func (h *Hub) checkID(client *Client) error {
+	if client.id == "" {
+		return errors.New("missing id")
+	}
+	if !client.bot && strings.HasPrefix(client.id, botIDPrefix) {
+		return errors.New("ids starting with " + botIDPrefix + " are reserved")
+	}
+	return nil
+}
+
+// replaceID unregisters the client registered with the id of client, if any.
+// Entities are owned by client id, so two connections sharing an id would
+// update and release each other's entities. The newest connection wins: the
+// old one may be a dropped connection waiting for its ping timeout.
+func (h *Hub) replaceID(client *Client) {
+	for c := range h.clients {
+		if c.id == client.id {
+			h.send(c, errorEnvelope("", errCodeRejected, replacedReason))
+			c.closeCode = websocket.CloseNormalClosure
+			c.closeReason = replacedReason
+			h.remove(c)
+		}
+	}
+}
+
+// authorizeEntities stamps the sender's id on every entity in sp and removes
+// the entities the sender is not allowed to update. An entity belongs to the
+// first client that sends an update for it or requests it, until that client
+// releases it, leaves the space, or the ownership policy gives it to another.
+// Entities without an id are rejected too. The ids of rejected entities are
+// returned.
+func (h *Hub) authorizeEntities(sender *Client, sp *server.SpacePresence, now time.Time) []string {
+	from := sender.id
+	var rejected []string
+	changes := sp.Changes[:0]
+	for _, e := range sp.Changes {
+		if e == nil {
+			continue
+		}
+		if e.Id == "" || (e.UserId != "" && e.UserId != from) {
+			rejected = append(rejected, e.Id)
+			continue
+		}
+		key := entityKey{sender.space, e.Id}
+		owner, ok := h.entityOwners[key]
+		if ok && owner.client != sender {
+			rejected = append(rejected, e.Id)
+			continue
+		}
+		if !ok {
+			h.setOwner(key, sender, now)
+		} else {
+			owner.updated = now
+		}
+		e.UserId = from
+		changes = append(changes, e)
+	}
+	sp.Changes = changes
+	return rejected
+}
+
+// releaseEntities drops the ownership of every entity owned by the client,
+// and tells its space.
+func (h *Hub) releaseEntities(client *Client) {
+	for key, owner := range h.entityOwners {
+		if owner.client == client {
+			h.setOwner(key, nil, time.Now())
+			h.resetEntity(key)
+		}
+	}
+}
+
+// resetEntity forgets what the hub and the clients kept of the updates of
+// the entity's previous owner: its movement baseline, its history, the zones
+// it is in, the delta baselines and the updates still waiting on the state
+// lanes.
+func (h *Hub) resetEntity(key entityKey) {
+	h.exitEntityZones(key)
+	h.history.forget(key)
+	h.forgetDelta(key)
+	h.forgetShown(key)
+	delete(h.moves, key)
+	for client := range h.clients {
+		delete(client.lod, key)
+		client.send.dropState(key)
+	}
+}
+
+func notOwnedError(collationID string, ids []string) *server.Envelope {
+	return errorEnvelope(collationID, errCodeEntityNotOwned,
+		fmt.Sprintf("entities not owned: %s", strings.Join(ids, ",")))
+}
@@ -0,0 +1,108 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"nakama/server"
+)
+
+func TestAuthorizeEntities(t *testing.T) {
+	sender := &Client{id: "a", space: "s", send: newSendQueue()}
+	other := &Client{id: "b", space: "s", send: newSendQueue()}
+	tests := []struct {
+		name         string
+		entity       *server.Entity
+		wantRejected []string
+	}{
+		{"unowned", &server.Entity{Id: "free"}, nil},
+		{"owned by the sender", &server.Entity{Id: "mine", UserId: "a"}, nil},
+		{"owned by another", &server.Entity{Id: "theirs"}, []string{"theirs"}},
+		{"id owned in another space", &server.Entity{Id: "elsewhere"}, nil},
+		{"user id of another", &server.Entity{Id: "free", UserId: "b"}, []string{"free"}},
+		{"no id", &server.Entity{}, []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Hub{
+				clients:      map[*Client]bool{sender: true, other: true},
+				entityOwners: make(map[entityKey]*entityOwner),
+			}
+			h.entityOwners[entityKey{"s", "mine"}] = &entityOwner{client: sender}
+			h.entityOwners[entityKey{"s", "theirs"}] = &entityOwner{client: other}
+			h.entityOwners[entityKey{"t", "elsewhere"}] = &entityOwner{client: other}
+			sp := &server.SpacePresence{Changes: []*server.Entity{tt.entity}}
+			rejected := h.authorizeEntities(sender, sp, time.Now())
+			if !reflect.DeepEqual(rejected, tt.wantRejected) {
+				t.Errorf("rejected %q, want %q", rejected, tt.wantRejected)
+			}
+			if len(tt.wantRejected) > 0 {
+				if len(sp.Changes) != 0 {
+					t.Errorf("changes %v kept", sp.Changes)
+				}
+				return
+			}
+			if len(sp.Changes) != 1 || sp.Changes[0].UserId != "a" {
+				t.Fatalf("changes %v, want the entity stamped with a", sp.Changes)
+			}
+			if owner := h.entityOwners[entityKey{"s", tt.entity.Id}]; owner == nil || owner.client != sender {
+				t.Errorf("%s not owned by the sender", tt.entity.Id)
+			}
+		})
+	}
+}
+
+func TestReplaceID(t *testing.T) {
+	old := &Client{id: "a", space: "s", send: newSendQueue()}
+	h := &Hub{
+		clients:      map[*Client]bool{old: true},
+		entityOwners: make(map[entityKey]*entityOwner),
+		moves:        make(map[entityKey]entityMove),
+		history:      newHistory(time.Second),
+		positions:    make(map[string]Vec3),
+		inZones:      make(map[entityKey]*entityZones),
+		matchmaker:   newMatchmaker(0),
+		hooks:        NoopHooks{},
+	}
+	h.entityOwners[entityKey{"s", "ball"}] = &entityOwner{client: old}
+	client := &Client{id: "a", space: "s", send: newSendQueue()}
+	if err := h.checkID(client); err != nil {
+		t.Fatalf("checkID: %v", err)
+	}
+	h.replaceID(client)
+	if h.clients[old] {
+		t.Error("old connection still registered")
+	}
+	if _, ok := h.entityOwners[entityKey{"s", "ball"}]; ok {
+		t.Error("entity of the old connection not released")
+	}
+	if _, ok := old.send.take(); ok {
+		t.Error("send queue of the old connection not closed")
+	}
+}
+
+func TestCheckID(t *testing.T) {
+	tests := []struct {
+		name    string
+		client  *Client
+		wantErr bool
+	}{
+		{"player", &Client{id: "a"}, false},
+		{"missing id", &Client{}, true},
+		{"bot prefix", &Client{id: "bot-s-1"}, true},
+		{"bot", &Client{id: "bot-s-1", bot: true}, false},
+	}
+	h := &Hub{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.checkID(tt.client); (err != nil) != tt.wantErr {
+				t.Errorf("checkID = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
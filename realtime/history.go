@@ -0,0 +1,119 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"sync"
+	"time"
+
+	"nakama/server"
+)
+
+// positionSample is an entity position as relayed at a hub tick.
+type positionSample struct {
+	at       time.Time
+	tick     int64
+	position Vec3
+}
+
+// positionRing holds the most recent samples of one entity, oldest first
+// starting at start.
+type positionRing struct {
+	samples []positionSample
+	start   int
+	n       int
+}
+
+func (r *positionRing) at(i int) *positionSample {
+	return &r.samples[(r.start+i)%len(r.samples)]
+}
+
+func (r *positionRing) push(s positionSample) {
+	// Keep one sample per tick so the capacity covers the whole window.
+	if r.n > 0 && r.at(r.n-1).tick == s.tick {
+		*r.at(r.n - 1) = s
+		return
+	}
+	if r.n < len(r.samples) {
+		r.n++
+	} else {
+		r.start = (r.start + 1) % len(r.samples)
+	}
+	*r.at(r.n - 1) = s
+}
+
+// History keeps the recent positions of every entity relayed by the hub so
+// server-side code can tell where an entity was at a past server time. It is
+// safe for concurrent use.
+type History struct {
+	mu       sync.RWMutex
+	window   time.Duration
+	capacity int
+	entities map[entityKey]*positionRing
+}
+
+func newHistory(window time.Duration) *History {
+	return &History{
+		window:   window,
+		capacity: int(window/tickPeriod) + 1,
+		entities: make(map[entityKey]*positionRing),
+	}
+}
+
+// record adds the positions in sp, relayed in space at time t and tick.
+func (hs *History) record(t time.Time, tick int64, space string, sp *server.SpacePresence) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for _, e := range sp.Changes {
+		if e.Position == nil {
+			continue
+		}
+		key := entityKey{space, e.Id}
+		r, ok := hs.entities[key]
+		if !ok {
+			r = &positionRing{samples: make([]positionSample, hs.capacity)}
+			hs.entities[key] = r
+		}
+		r.push(positionSample{at: t, tick: tick, position: vec3From(e.Position)})
+	}
+}
+
+// forget drops the history of an entity.
+func (hs *History) forget(key entityKey) {
+	hs.mu.Lock()
+	delete(hs.entities, key)
+	hs.mu.Unlock()
+}
+
+// PositionAt returns the position of the entity of the space at time t,
+// interpolated between the two samples around t. A time after the newest
+// sample returns the newest position. It returns false if the entity is
+// unknown or t is older than the history window.
+func (hs *History) PositionAt(space, entityID string, t time.Time) (*server.V3, bool) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	r, ok := hs.entities[entityKey{space, entityID}]
+	if !ok || r.n == 0 || t.Before(time.Now().Add(-hs.window)) {
+		return nil, false
+	}
+	if t.Before(r.at(0).at) {
+		return nil, false
+	}
+	for i := 1; i < r.n; i++ {
+		a, b := r.at(i-1), r.at(i)
+		if t.After(b.at) {
+			continue
+		}
+		f := float32(t.Sub(a.at)) / float32(b.at.Sub(a.at))
+		return a.position.lerp(b.position, f).V3(), true
+	}
+	return r.at(r.n - 1).position.V3(), true
+}
+
+// PositionAt returns where the entity of the space was at server time t. See
+// History.PositionAt.
+func (h *Hub) PositionAt(space, entityID string, t time.Time) (*server.V3, bool) {
+	return h.history.PositionAt(space, entityID, t)
+}
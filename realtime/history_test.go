@@ -0,0 +1,111 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"nakama/server"
+)
+
+// recordX records entity e of space s at x, at time t and tick.
+func recordX(hs *History, t time.Time, tick int64, x float32) {
+	hs.record(t, tick, "s", &server.SpacePresence{Changes: []*server.Entity{{Id: "e", Position: &server.V3{X: x}}}})
+}
+
+func TestPositionAt(t *testing.T) {
+	now := time.Now()
+	hs := newHistory(time.Second)
+	recordX(hs, now.Add(-300*time.Millisecond), 1, 0)
+	recordX(hs, now.Add(-200*time.Millisecond), 2, 10)
+	recordX(hs, now.Add(-100*time.Millisecond), 3, 20)
+	tests := []struct {
+		name     string
+		entityID string
+		at       time.Duration
+		want     float32
+		wantOK   bool
+	}{
+		{"oldest sample", "e", -300 * time.Millisecond, 0, true},
+		{"between samples", "e", -250 * time.Millisecond, 5, true},
+		{"later pair", "e", -125 * time.Millisecond, 17.5, true},
+		{"newest sample", "e", -100 * time.Millisecond, 20, true},
+		{"after the newest sample", "e", 0, 20, true},
+		{"before the oldest sample", "e", -400 * time.Millisecond, 0, false},
+		{"older than the window", "e", -2 * time.Second, 0, false},
+		{"unknown entity", "f", -100 * time.Millisecond, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := hs.PositionAt("s", tt.entityID, now.Add(tt.at))
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && (p.X-tt.want > 1e-3 || tt.want-p.X > 1e-3) {
+				t.Errorf("x = %v, want %v", p.X, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryRing(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		ticks   []int64
+		wantN   int
+		wantX   float32
+		oldestX float32
+	}{
+		{"one sample per tick", []int64{1, 1, 1}, 1, 2, 2},
+		{"under capacity", []int64{1, 2, 3}, 3, 2, 0},
+		{"oldest dropped", []int64{1, 2, 3, 4, 5, 6, 7}, 6, 6, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Five ticks of window keep six samples.
+			hs := newHistory(5 * tickPeriod)
+			for i, tick := range tt.ticks {
+				recordX(hs, now.Add(time.Duration(i)*time.Millisecond), tick, float32(i))
+			}
+			r := hs.entities[entityKey{"s", "e"}]
+			if r.n != tt.wantN {
+				t.Fatalf("%d samples, want %d", r.n, tt.wantN)
+			}
+			if x := r.at(r.n - 1).position.X; x != tt.wantX {
+				t.Errorf("newest x = %v, want %v", x, tt.wantX)
+			}
+			if x := r.at(0).position.X; x != tt.oldestX {
+				t.Errorf("oldest x = %v, want %v", x, tt.oldestX)
+			}
+		})
+	}
+}
+
+func TestHistoryForget(t *testing.T) {
+	now := time.Now()
+	hs := newHistory(time.Second)
+	recordX(hs, now, 1, 1)
+	hs.forget(entityKey{"s", "e"})
+	if _, ok := hs.PositionAt("s", "e", now); ok {
+		t.Error("forgotten entity still has a position")
+	}
+}
+
+func TestHistorySpaces(t *testing.T) {
+	now := time.Now()
+	hs := newHistory(time.Second)
+	recordX(hs, now, 1, 1)
+	hs.record(now, 1, "t", &server.SpacePresence{Changes: []*server.Entity{{Id: "e", Position: &server.V3{X: 2}}}})
+	for space, want := range map[string]float32{"s": 1, "t": 2} {
+		if p, ok := hs.PositionAt(space, "e", now); !ok || p.X != want {
+			t.Errorf("e of %s at %v, want %v", space, p, want)
+		}
+	}
+	if _, ok := hs.PositionAt("u", "e", now); ok {
+		t.Error("e has a position in a space it was never in")
+	}
+}
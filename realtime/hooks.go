@@ -0,0 +1,85 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"errors"
+
+	"nakama/server"
+)
+
+// ErrRPCNotFound is returned by Hooks.OnRPC for the rpc ids it does not
+// handle. Such rpcs are relayed to the space like any other envelope.
+var ErrRPCNotFound = errors.New("rpc not found")
+
+// Hooks lets custom server logic run at defined points of the hub. All
+// methods are called from the hub goroutine, so they must not block.
+type Hooks interface {
+	// OnConnect is called when a client registers. Returning an error rejects
+	// the client: it gets the error and its connection is closed.
+	OnConnect(client *Client) error
+
+	// OnDisconnect is called after a client unregistered.
+	OnDisconnect(client *Client)
+
+	// BeforeBroadcast is called with every envelope about to be relayed.
+	// It returns the envelope to relay, which may be e modified or another
+	// one, and false to drop it.
+	BeforeBroadcast(sender *Client, e *server.Envelope) (*server.Envelope, bool)
+
+	// AfterBroadcast is called with every envelope once it has been relayed.
+	AfterBroadcast(sender *Client, e *server.Envelope)
+
+	// OnRPC is called with the rpcs the hub does not handle itself. The
+	// returned payload is sent back to the client in an rpc with the same id.
+	OnRPC(client *Client, id, payload string) (string, error)
+}
+
+// ZoneHooks is implemented by the Hooks that also get the zone events. The
+// hub checks for it with a type assertion.
+type ZoneHooks interface {
+	// OnZoneEvent is called when an entity of the client enters or leaves
+	// a zone.
+	OnZoneEvent(client *Client, event *ZoneEvent)
+}
+
+// NoopHooks implements Hooks and ZoneHooks and does nothing. Embed it to
+// implement only some of the hooks.
+type NoopHooks struct{}
+
+func (NoopHooks) OnConnect(client *Client) error { return nil }
+
+func (NoopHooks) OnDisconnect(client *Client) {}
+
+func (NoopHooks) BeforeBroadcast(sender *Client, e *server.Envelope) (*server.Envelope, bool) {
+	return e, true
+}
+
+func (NoopHooks) AfterBroadcast(sender *Client, e *server.Envelope) {}
+
+func (NoopHooks) OnRPC(client *Client, id, payload string) (string, error) {
+	return "", ErrRPCNotFound
+}
+
+func (NoopHooks) OnZoneEvent(client *Client, event *ZoneEvent) {}
+
+// callRPCHook passes the rpc in e to the hooks and answers the client. It
+// reports whether the hooks handled the rpc.
+func (h *Hub) callRPCHook(message *MessageEnvelope, e *server.Envelope) bool {
+	rpc := e.GetRpc()
+	result, err := h.hooks.OnRPC(message.sender, rpc.Id, rpc.Payload)
+	switch {
+	case err == ErrRPCNotFound:
+		return false
+	case err != nil:
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRuntime, err.Error()))
+	default:
+		h.send(message.sender, &server.Envelope{
+			CollationId: e.CollationId,
+			Payload:     &server.Envelope_Rpc{Rpc: &server.TRpc{Id: rpc.Id, Payload: result}},
+		})
+	}
+	return true
+}
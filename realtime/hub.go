@@ -0,0 +1,573 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"nakama/server"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+type MessageEnvelope struct {
+	fromClient string
+	data       []byte
+
+	// Client the message was read from.
+	sender *Client
+
+	// Time the message was read from the connection.
+	receivedAt time.Time
+
+	// The decoded message, nil if it is not an envelope.
+	envelope *server.Envelope
+
+	// Server time and tick a SpacePresence update was relayed at.
+	tick *serverTick
+}
+
+// hub maintains the set of active clients and broadcasts messages to the
+// clients.
+type Hub struct {
+	// Registered clients.
+	clients map[*Client]bool
+
+	// Owner of each entity seen in a SpacePresence update or requested.
+	entityOwners map[entityKey]*entityOwner
+
+	// Inbound messages from the clients.
+	broadcast chan *MessageEnvelope
+
+	// Register requests from the clients.
+	register chan *Client
+
+	// Unregister requests from clients.
+	unregister chan *Client
+
+	// Closed to stop the hub.
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// Running writePumps, which flush the send queues of the clients.
+	pumps sync.WaitGroup
+
+	// Functions to run on the hub goroutine.
+	calls chan func()
+
+	// Handlers of the rpcs addressed to the server, by rpc id.
+	rpcs map[string]rpcFunc
+
+	hooks Hooks
+
+	// Number of ticks since the hub started.
+	tick int64
+
+	// Recent entity positions, for lag compensation.
+	history *History
+
+	matchmaker *Matchmaker
+
+	// Running authoritative matches by id, and their events.
+	matches       map[string]*match
+	matchHandlers map[string]func() MatchHandler
+	matchJoins    chan *matchJoinResult
+	matchOutputs  chan *matchOutput
+	matchEnded    chan *match
+
+	bots BotConfig
+
+	// Lua runtime, nil if no Lua modules are loaded.
+	lua *LuaRuntime
+
+	// Unreliable channel for SpacePresence updates, nil if disabled.
+	udp        *UDPChannel
+	udpPackets chan *udpPacket
+
+	// Quantum of the delta positions, zero if they are not quantized, and
+	// period of the full updates of an entity.
+	deltaQuantum  float32
+	deltaKeyframe time.Duration
+
+	// Movement rules by space, and the last accepted position of each
+	// entity.
+	movement map[string]*MovementRules
+	moves    map[entityKey]entityMove
+
+	// Decides who gets the entities requested by clients.
+	ownership OwnershipPolicy
+
+	// Shared properties of each space, and the last version given to a
+	// property.
+	spaceProps  map[string]map[string]*spaceProp
+	propVersion int64
+
+	// Kicks and mutes by user and space, kept across reconnections.
+	sanctions map[sanctionKey]*sanction
+
+	// Teams players are spread over, and the fog of war between them, nil
+	// if teams see each other.
+	teams []string
+	fog   *FogOfWar
+
+	// Key of the moderator sessions, empty if there are none.
+	moderatorKey string
+
+	// Zones by space, and the zones each entity is in.
+	zones   map[string][]Zone
+	inZones map[entityKey]*entityZones
+
+	// Update rates by distance, and the last known position of each client.
+	lodBands  []LODBand
+	positions map[string]Vec3
+
+	// Period of the connection_quality rpcs, zero if they are not sent.
+	qualityInterval time.Duration
+
+	// Stored chat messages and the members of each chat channel.
+	chat            *ChatStore
+	channels        map[string]map[*Client]bool
+	chatJoinHistory int
+}
+
+func newHub(config *Options) (*Hub, error) {
+	if config.HistoryWindow < 0 {
+		return nil, fmt.Errorf("negative history window %v", config.HistoryWindow)
+	}
+	if config.Bots.Rate > maxBotRate {
+		return nil, fmt.Errorf("bot rate %d over %d", config.Bots.Rate, maxBotRate)
+	}
+	var chat *ChatStore
+	if config.ChatDB != "" {
+		var err error
+		if chat, err = openChatStore(config.ChatDB); err != nil {
+			return nil, err
+		}
+	}
+	hooks := config.Hooks
+	if hooks == nil {
+		hooks = NoopHooks{}
+	}
+	var runtime *LuaRuntime
+	if config.LuaDir != "" {
+		runtime = newLuaRuntime(hooks)
+		hooks = runtime
+	}
+	var udp *UDPChannel
+	if config.UDPAddr != "" {
+		var err error
+		if udp, err = listenUDP(config.UDPAddr); err != nil {
+			if runtime != nil {
+				runtime.Close()
+			}
+			if chat != nil {
+				chat.Close()
+			}
+			return nil, err
+		}
+	}
+	h := &Hub{
+		hooks:           hooks,
+		lua:             runtime,
+		udp:             udp,
+		udpPackets:      make(chan *udpPacket, 256),
+		history:         newHistory(config.HistoryWindow),
+		matchmaker:      newMatchmaker(config.TicketTimeout),
+		matches:         make(map[string]*match),
+		matchHandlers:   config.MatchHandlers,
+		matchJoins:      make(chan *matchJoinResult),
+		matchOutputs:    make(chan *matchOutput),
+		matchEnded:      make(chan *match),
+		bots:            config.Bots,
+		chat:            chat,
+		channels:        make(map[string]map[*Client]bool),
+		chatJoinHistory: config.ChatJoinHistory,
+		qualityInterval: config.QualityInterval,
+		deltaQuantum:    config.DeltaQuantum,
+		deltaKeyframe:   config.DeltaKeyframe,
+		lodBands:        config.LODBands,
+		movement:        config.Movement,
+		moves:           make(map[entityKey]entityMove),
+		zones:           config.Zones,
+		moderatorKey:    config.ModeratorKey,
+		teams:           config.Teams,
+		spaceProps:      make(map[string]map[string]*spaceProp),
+		sanctions:       make(map[sanctionKey]*sanction),
+		ownership:       config.Ownership,
+		fog:             config.FogOfWar,
+		inZones:         make(map[entityKey]*entityZones),
+		positions:       make(map[string]Vec3),
+		broadcast:       make(chan *MessageEnvelope),
+		register:        make(chan *Client),
+		unregister:      make(chan *Client),
+		quit:            make(chan struct{}),
+		calls:           make(chan func()),
+		clients:         make(map[*Client]bool),
+		entityOwners:    make(map[entityKey]*entityOwner),
+	}
+	h.rpcs = map[string]rpcFunc{
+		rpcClockSync:        h.answerClockSync,
+		rpcMatchmakerAdd:    h.addTicket,
+		rpcMatchmakerRemove: h.removeTicket,
+		rpcChatJoin:         h.joinChat,
+		rpcChatLeave:        h.leaveChat,
+		rpcChatSend:         h.sendChat,
+		rpcChatHistory:      h.chatHistory,
+		rpcMatchCreate:      h.createMatch,
+		rpcMatchJoin:        h.joinMatch,
+		rpcMatchLeave:       h.leaveMatch,
+		rpcUDPBind:          h.bindUDP,
+		rpcDeltaEnable:      h.enableDelta,
+		rpcDeltaResync:      h.resyncDelta,
+		rpcDeltaAck:         h.ackDelta,
+		rpcZoneSubscribe:    h.subscribeZones,
+		rpcZoneUnsubscribe:  h.subscribeZones,
+		rpcModerateKick:     h.moderate,
+		rpcModerateMute:     h.moderate,
+		rpcModerateUnmute:   h.moderate,
+		rpcSpaceSet:         h.setSpaceProps,
+		rpcEntityRequest:    h.requestEntity,
+		rpcEntityRelease:    h.releaseEntity,
+	}
+	if runtime != nil {
+		runtime.hub = h
+		if err := runtime.load(config.LuaDir); err != nil {
+			runtime.Close()
+			h.release()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// run processes the hub events until the hub is stopped, then releases the
+// resources of the hub.
+func (h *Hub) run() {
+	defer h.close()
+	ticker := time.NewTicker(tickPeriod)
+	defer ticker.Stop()
+	matchTicker := time.NewTicker(matchmakerInterval)
+	defer matchTicker.Stop()
+	var qualityTicker <-chan time.Time
+	if h.qualityInterval > 0 {
+		t := time.NewTicker(h.qualityInterval)
+		defer t.Stop()
+		qualityTicker = t.C
+	}
+	h.spawnBots(&h.bots)
+	if h.udp != nil {
+		go h.udp.readPump(h.udpPackets, h.quit)
+	}
+	for {
+		select {
+		case now := <-ticker.C:
+			h.tick++
+			h.flushLOD(now)
+		case <-matchTicker.C:
+			h.matchmake()
+		case <-qualityTicker:
+			h.sendQuality()
+		case result := <-h.matchJoins:
+			h.handleMatchJoin(result)
+		case output := <-h.matchOutputs:
+			h.handleMatchOutput(output)
+		case m := <-h.matchEnded:
+			h.handleMatchEnded(m)
+		case client := <-h.register:
+			if client.transport != nil {
+				// Counted here so the count is final once run returns.
+				h.pumps.Add(1)
+			}
+			if err := h.checkID(client); err != nil {
+				h.reject(client, err)
+				continue
+			}
+			if _, ok := h.matches[client.space]; ok {
+				h.reject(client, errMatchSpace)
+				continue
+			}
+			if h.banned(client, time.Now()) {
+				h.reject(client, errKicked)
+				continue
+			}
+			h.assignTeam(client)
+			if err := h.hooks.OnConnect(client); err != nil {
+				h.reject(client, err)
+				continue
+			}
+			h.replaceID(client)
+			h.clients[client] = true
+			h.sendTeam(client)
+			h.sendSpaceState(client)
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
+				h.remove(client)
+			}
+		case p := <-h.udpPackets:
+			if message := h.acceptUDP(p); message != nil {
+				h.relay(message)
+			}
+		case message := <-h.broadcast:
+			h.relay(message)
+		case fn := <-h.calls:
+			fn()
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// reject tells a registering client why it is refused and closes its queue.
+func (h *Hub) reject(client *Client, err error) {
+	h.send(client, errorEnvelope("", errCodeRejected, err.Error()))
+	client.send.close()
+}
+
+// call runs fn on the hub goroutine and waits for it. It reports false if
+// the hub is stopped.
+func (h *Hub) call(fn func()) bool {
+	done := make(chan struct{})
+	select {
+	case h.calls <- func() { fn(); close(done) }:
+		<-done
+		return true
+	case <-h.quit:
+		return false
+	}
+}
+
+// release closes the chat database and the udp socket so another process can
+// open them. Chat rpcs fail from then on and SpacePresence updates go over
+// the websockets.
+func (h *Hub) release() {
+	if h.udp != nil {
+		h.udp.Close()
+		h.udp = nil
+	}
+	if h.chat != nil {
+		h.chat.Close()
+		h.chat = nil
+	}
+}
+
+// stop makes run return. The goroutines talking to the hub give up once it
+// is stopped.
+func (h *Hub) stop() {
+	h.quitOnce.Do(func() { close(h.quit) })
+}
+
+// registerClient asks the hub to register the client. It reports false if
+// the hub is stopped.
+func (h *Hub) registerClient(client *Client) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.quit:
+		return false
+	}
+}
+
+func (h *Hub) unregisterClient(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.quit:
+	}
+}
+
+// broadcastMessage hands a message to the hub. It reports false if the hub
+// is stopped.
+func (h *Hub) broadcastMessage(message *MessageEnvelope) bool {
+	select {
+	case h.broadcast <- message:
+		return true
+	case <-h.quit:
+		return false
+	}
+}
+
+// close releases the resources of the hub and disconnects the clients. They
+// get a server_shutdown rpc and a going away close frame once their pending
+// messages are written.
+func (h *Hub) close() {
+	notice := rpcEnvelope(rpcServerShutdown, "", &serverShutdown{Reason: shutdownReason})
+	for client := range h.clients {
+		client.closeCode = websocket.CloseGoingAway
+		client.closeReason = shutdownReason
+		delete(h.clients, client)
+		if data, ok := encodeFor(client, notice); ok {
+			client.send.closeWith(laneReliable, data)
+		} else {
+			client.send.close()
+		}
+	}
+	for _, m := range h.matches {
+		close(m.stop)
+	}
+	if h.lua != nil {
+		h.lua.Close()
+	}
+	h.release()
+}
+
+// relay sends a message of a client to the other clients of its space that
+// may see it.
+// SpacePresence updates are throttled by distance and sent with sendState.
+// Clients whose reliable lane is full are disconnected.
+func (h *Hub) relay(message *MessageEnvelope) {
+	// fmt.Println("Broadcast: ", string(message))
+	if !h.clients[message.sender] || !h.filter(message) {
+		return
+	}
+	var parts []*statePart
+	unreliable := message.envelope != nil && message.envelope.GetSpacePresence() != nil
+	if unreliable {
+		parts = stateParts(message)
+		h.trackPosition(message)
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	f := &frame{data: message.data}
+	for client := range h.clients {
+		if client.id == message.fromClient {
+			// skip sending message to itself
+			continue
+		}
+		if client.space != message.sender.space || !h.visible(client, message) {
+			continue
+		}
+		if unreliable {
+			for _, part := range parts {
+				h.sendEntityState(client, message, part, seen, now)
+			}
+			continue
+		}
+		if !client.send.push(laneReliable, f.dataFor(client)) {
+			fmt.Println("close client early: ")
+			h.remove(client)
+		}
+	}
+	if message.envelope != nil {
+		h.hooks.AfterBroadcast(message.sender, message.envelope)
+	}
+}
+
+// sendState sends the update of an entity to the client: as a delta if it
+// asked for them, over udp if it bound a udp session, or on its state lane.
+func (h *Hub) sendState(client *Client, message *MessageEnvelope, part *statePart) {
+	if client.delta != nil {
+		h.sendDelta(client, part.entity.space, part.sp, part.tick, message.receivedAt)
+		return
+	}
+	if !h.sendUDP(client, part.tick, part.frame.data) {
+		client.send.pushState(part.entity, part.stamp.dataFor(client), part.frame.dataFor(client))
+	}
+}
+
+// moveSpace moves the client to another space. It leaves the authoritative
+// match it was in, its entities leave the zones of the old space and are
+// released as they stay in it. The updates held back for it and its
+// position, which is only meaningful in the old space, are dropped, and it
+// is put in a team of the new space and sent its properties.
+func (h *Hub) moveSpace(client *Client, space string) {
+	if client.space == space {
+		return
+	}
+	if m, ok := h.matches[client.space]; ok {
+		h.leave(m, client)
+	}
+	h.exitZones(client)
+	h.releaseEntities(client)
+	client.lod = make(map[entityKey]*lodEntry)
+	delete(h.positions, client.id)
+	h.dropSpaceProps(client)
+	client.space = space
+	h.reassignTeam(client)
+	h.sendSpaceState(client)
+}
+
+// remove unregisters the client and releases everything it holds.
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client)
+	client.send.close()
+	h.exitZones(client)
+	h.releaseEntities(client)
+	delete(h.positions, client.id)
+	h.unbindUDP(client)
+	h.matchmaker.removeClient(client)
+	if m, ok := h.matches[client.space]; ok {
+		h.leave(m, client)
+	}
+	for channel := range h.channels {
+		h.leaveChannel(channel, client)
+	}
+	h.dropSpaceProps(client)
+	h.hooks.OnDisconnect(client)
+}
+
+// filter prepares message for broadcasting and reports whether anything is
+// left to broadcast. Rpcs addressed to the server are handled here and not
+// broadcast, spectators and muted clients are stopped, envelopes of
+// authoritative match members go to their match.
+// SpacePresence updates are checked against the entities the sender owns,
+// given the server time and tick they are relayed at, and validated against
+// the movement rules of the space. The envelope then goes through the
+// BeforeBroadcast hook and message.data is rewritten. The positions of an
+// accepted SpacePresence are recorded in the history, and its entities
+// crossing a zone boundary emit zone events. Messages that are not envelopes
+// are relayed untouched outside of matches.
+func (h *Hub) filter(message *MessageEnvelope) bool {
+	now := time.Now()
+	e := &server.Envelope{}
+	if err := proto.Unmarshal(message.data, e); err != nil {
+		return h.mayRelay(message, nil) && !h.routeToMatch(message, nil)
+	}
+	if rpc := e.GetRpc(); rpc != nil {
+		if !h.mayCall(message, e) {
+			return false
+		}
+		if handler, ok := h.rpcs[rpc.Id]; ok {
+			handler(message, e)
+			return false
+		}
+		if h.callRPCHook(message, e) {
+			return false
+		}
+	}
+	if !h.mayRelay(message, e) || h.routeToMatch(message, e) {
+		return false
+	}
+	if sp := e.GetSpacePresence(); sp != nil {
+		if rejected := h.authorizeEntities(message.sender, sp, message.receivedAt); len(rejected) > 0 {
+			h.send(message.sender, notOwnedError(e.CollationId, rejected))
+			if len(sp.Changes) == 0 {
+				return false
+			}
+		}
+		message.tick = &serverTick{ServerTime: unixMillis(now), Tick: h.tick}
+		if !h.validateMovement(message, sp) || len(sp.Changes) == 0 {
+			return false
+		}
+	}
+	e, ok := h.hooks.BeforeBroadcast(message.sender, e)
+	if !ok || e == nil {
+		return false
+	}
+	if sp := e.GetSpacePresence(); sp != nil {
+		// Only what is relayed is recorded, as the hook may drop or
+		// rewrite entities.
+		h.history.record(now, h.tick, message.sender.space, sp)
+		h.crossZones(message.sender, sp, now)
+	}
+	data, err := marshal(e)
+	if err != nil {
+		return false
+	}
+	message.envelope = e
+	message.data = data
+	return true
+}
@@ -0,0 +1,126 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"time"
+
+	"nakama/server"
+)
+
+// LODBand sets the update rate of the entities within Distance of a client.
+type LODBand struct {
+	Distance float32
+
+	// Updates sent per second, zero for every update.
+	Rate int
+}
+
+// lodEntry tracks the updates of an entity to one client.
+type lodEntry struct {
+	// When the last update was sent, and the interval before the next one.
+	sent     time.Time
+	interval time.Duration
+
+	// Newest update held back and the message it came in, nil if none.
+	pending *MessageEnvelope
+	part    *statePart
+}
+
+// trackPosition records where the sender of a SpacePresence update is, from
+// the last of its entities with a position.
+func (h *Hub) trackPosition(message *MessageEnvelope) {
+	for _, entity := range message.envelope.GetSpacePresence().Changes {
+		if entity.Position != nil {
+			h.positions[message.fromClient] = vec3From(entity.Position)
+		}
+	}
+}
+
+// lodInterval returns the interval between the updates of sp sent to the
+// client, from the band of its nearest entity. Entities beyond the last band
+// get its rate. It returns zero if every update is sent.
+func (h *Hub) lodInterval(client *Client, sp *server.SpacePresence) time.Duration {
+	if len(h.lodBands) == 0 {
+		return 0
+	}
+	position, ok := h.positions[client.id]
+	if !ok {
+		return 0
+	}
+	distance := float32(-1)
+	for _, entity := range sp.Changes {
+		if entity.Position == nil {
+			continue
+		}
+		d := vec3From(entity.Position).sub(position).length()
+		if distance < 0 || d < distance {
+			distance = d
+		}
+	}
+	if distance < 0 {
+		return 0
+	}
+	band := h.lodBands[len(h.lodBands)-1]
+	for _, b := range h.lodBands {
+		if distance <= b.Distance {
+			band = b
+			break
+		}
+	}
+	if band.Rate <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(band.Rate)
+}
+
+// throttle reports whether the update of an entity may be sent to the client
+// now. Otherwise it is held back until flushLOD sends it, replacing the
+// update of the entity held back before it.
+func (h *Hub) throttle(client *Client, message *MessageEnvelope, part *statePart, now time.Time) bool {
+	interval := h.lodInterval(client, part.sp)
+	entry, ok := client.lod[part.entity]
+	if interval == 0 && !ok {
+		return true
+	}
+	if !ok {
+		entry = &lodEntry{}
+		client.lod[part.entity] = entry
+	}
+	entry.interval = interval
+	if now.Sub(entry.sent) < interval {
+		entry.pending, entry.part = message, part
+		return false
+	}
+	entry.sent, entry.pending, entry.part = now, nil, nil
+	return true
+}
+
+// flushLOD sends the updates held back whose interval elapsed, and forgets
+// the entities the clients are up to date with. Updates whose sender left or
+// changed space are dropped.
+func (h *Hub) flushLOD(now time.Time) {
+	for client := range h.clients {
+		for key, entry := range client.lod {
+			if now.Sub(entry.sent) < entry.interval {
+				continue
+			}
+			if entry.pending == nil {
+				delete(client.lod, key)
+				continue
+			}
+			if sender := entry.pending.sender; !h.clients[sender] || sender.space != client.space {
+				delete(client.lod, key)
+				continue
+			}
+			if h.fogged(client, entry.pending.sender, entry.part.sp, nil) {
+				h.hideEntity(client, key)
+				continue
+			}
+			h.sendState(client, entry.pending, entry.part)
+			entry.sent, entry.pending, entry.part = now, nil, nil
+		}
+	}
+}
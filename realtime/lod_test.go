@@ -0,0 +1,67 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"nakama/server"
+)
+
+func TestFlushLOD(t *testing.T) {
+	tests := []struct {
+		name        string
+		senderSpace string
+		registered  bool
+		want        int
+	}{
+		{"same space", "s", true, 1},
+		{"sender moved", "t", true, 0},
+		{"sender left", "s", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{id: "a", space: "s", send: newSendQueue(), lod: make(map[entityKey]*lodEntry)}
+			sender := &Client{id: "b", space: tt.senderSpace, send: newSendQueue()}
+			h := &Hub{clients: map[*Client]bool{client: true}}
+			if tt.registered {
+				h.clients[sender] = true
+			}
+			sp := &server.SpacePresence{Changes: []*server.Entity{{Id: "e", Position: &server.V3{}}}}
+			message := &MessageEnvelope{sender: sender, fromClient: sender.id}
+			part := &statePart{entity: entityKey{"s", "e"}, sp: sp, frame: &frame{data: []byte("e")}, tick: &serverTick{}, stamp: &frame{data: []byte("t")}}
+			now := time.Now()
+			client.lod[entityKey{"s", "e"}] = &lodEntry{sent: now.Add(-time.Second), interval: time.Millisecond, pending: message, part: part}
+			h.flushLOD(now)
+			if n := client.send.len(); n != tt.want {
+				t.Errorf("%d updates sent, want %d", n, tt.want)
+			}
+			if entry, ok := client.lod[entityKey{"s", "e"}]; ok && entry.pending != nil {
+				t.Error("update still held back")
+			}
+		})
+	}
+}
+
+func TestMoveSpaceDropsLOD(t *testing.T) {
+	client := &Client{id: "a", space: "s", send: newSendQueue(), lod: make(map[entityKey]*lodEntry)}
+	client.lod[entityKey{"s", "e"}] = &lodEntry{}
+	h := &Hub{
+		clients:      map[*Client]bool{client: true},
+		entityOwners: make(map[entityKey]*entityOwner),
+		positions:    map[string]Vec3{"a": {X: 1}},
+	}
+	h.moveSpace(client, "t")
+	if client.space != "t" {
+		t.Fatalf("space %q, want t", client.space)
+	}
+	if len(client.lod) != 0 {
+		t.Error("updates of the old space still held back")
+	}
+	if _, ok := h.positions["a"]; ok {
+		t.Error("position in the old space kept")
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"nakama/server"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Events Lua modules can register hooks for with nk.register_hook.
+const (
+	luaHookConnect         = "connect"
+	luaHookDisconnect      = "disconnect"
+	luaHookBeforeBroadcast = "before_broadcast"
+	luaHookAfterBroadcast  = "after_broadcast"
+	luaHookZoneEnter       = "zone_enter"
+	luaHookZoneExit        = "zone_exit"
+)
+
+const (
+	// Longest a module may run when it is loaded.
+	luaLoadTimeout = 10 * time.Second
+
+	// Longest an rpc function or hook may run. The hub waits for it.
+	luaCallTimeout = 100 * time.Millisecond
+)
+
+// LuaRuntime runs the Lua modules of a directory. Modules use the nk table
+// to register rpc functions and hooks, send messages, query presence and
+// log:
+//
+//	nk.register_rpc(id, fn)           fn(user_id, payload) -> payload
+//	nk.register_hook(event, fn)       see the luaHook constants
+//	nk.send(user_id, rpc_id, payload)
+//	nk.broadcast(space, rpc_id, payload)
+//	nk.presences(space)               -> list of user ids, without spectators
+//	nk.logger_info(msg), nk.logger_warn(msg), nk.logger_error(msg)
+//
+// LuaRuntime implements Hooks and runs the hooks of next after its own. It is
+// only called from the hub goroutine.
+type LuaRuntime struct {
+	L     *lua.LState
+	hub   *Hub
+	next  Hooks
+	rpcs  map[string]*lua.LFunction
+	hooks map[string][]*lua.LFunction
+}
+
+// newLuaRuntime returns a runtime without modules. They are loaded once the
+// runtime is wired to its hub, as they may use it at load time.
+func newLuaRuntime(next Hooks) *LuaRuntime {
+	r := &LuaRuntime{
+		L:     lua.NewState(),
+		next:  next,
+		rpcs:  make(map[string]*lua.LFunction),
+		hooks: make(map[string][]*lua.LFunction),
+	}
+	r.L.SetGlobal("nk", r.L.SetFuncs(r.L.NewTable(), map[string]lua.LGFunction{
+		"register_rpc":  r.registerRPC,
+		"register_hook": r.registerHook,
+		"send":          r.send,
+		"broadcast":     r.broadcast,
+		"presences":     r.presences,
+		"logger_info":   r.logger("INFO"),
+		"logger_warn":   r.logger("WARN"),
+		"logger_error":  r.logger("ERROR"),
+	}))
+	return r
+}
+
+// load runs every .lua file of dir, in name order.
+func (r *LuaRuntime) load(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() && filepath.Ext(f.Name()) == ".lua" {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := r.withTimeout(luaLoadTimeout, func() error {
+			return r.L.DoFile(filepath.Join(dir, name))
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("lua: loaded module %s", name)
+	}
+	return nil
+}
+
+// withTimeout runs fn, stopping the Lua code it runs after timeout.
+func (r *LuaRuntime) withTimeout(timeout time.Duration, fn func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.L.SetContext(ctx)
+	defer r.L.RemoveContext()
+	return fn()
+}
+
+func (r *LuaRuntime) Close() {
+	r.L.Close()
+}
+
+func (r *LuaRuntime) registerRPC(L *lua.LState) int {
+	r.rpcs[L.CheckString(1)] = L.CheckFunction(2)
+	return 0
+}
+
+func (r *LuaRuntime) registerHook(L *lua.LState) int {
+	event := L.CheckString(1)
+	switch event {
+	case luaHookConnect, luaHookDisconnect, luaHookBeforeBroadcast, luaHookAfterBroadcast,
+		luaHookZoneEnter, luaHookZoneExit:
+	default:
+		L.ArgError(1, "unknown hook "+event)
+	}
+	r.hooks[event] = append(r.hooks[event], L.CheckFunction(2))
+	return 0
+}
+
+func (r *LuaRuntime) send(L *lua.LState) int {
+	userID, rpcID, payload := L.CheckString(1), L.CheckString(2), L.OptString(3, "")
+	e := &server.Envelope{Payload: &server.Envelope_Rpc{Rpc: &server.TRpc{Id: rpcID, Payload: payload}}}
+	for client := range r.hub.clients {
+		if client.id == userID {
+			r.hub.sendOn(client, laneReliable, e)
+		}
+	}
+	return 0
+}
+
+func (r *LuaRuntime) broadcast(L *lua.LState) int {
+	space, rpcID, payload := L.CheckString(1), L.CheckString(2), L.OptString(3, "")
+	e := &server.Envelope{Payload: &server.Envelope_Rpc{Rpc: &server.TRpc{Id: rpcID, Payload: payload}}}
+	for client := range r.hub.clients {
+		if client.space == space {
+			r.hub.sendOn(client, laneReliable, e)
+		}
+	}
+	return 0
+}
+
+func (r *LuaRuntime) presences(L *lua.LState) int {
+	space := L.CheckString(1)
+	t := L.NewTable()
+	for client := range r.hub.clients {
+		if client.space == space && client.role != RoleSpectator {
+			t.Append(lua.LString(client.id))
+		}
+	}
+	L.Push(t)
+	return 1
+}
+
+func (r *LuaRuntime) logger(level string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		log.Printf("lua: %s %s", level, L.CheckString(1))
+		return 0
+	}
+}
+
+// call runs fn with args and returns its result. fn fails if it runs longer
+// than luaCallTimeout.
+func (r *LuaRuntime) call(fn *lua.LFunction, args ...lua.LValue) (lua.LValue, error) {
+	err := r.withTimeout(luaCallTimeout, func() error {
+		return r.L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...)
+	})
+	if err != nil {
+		return lua.LNil, err
+	}
+	ret := r.L.Get(-1)
+	r.L.Pop(1)
+	return ret, nil
+}
+
+func (r *LuaRuntime) clientTable(client *Client) *lua.LTable {
+	t := r.L.NewTable()
+	t.RawSetString("user_id", lua.LString(client.id))
+	t.RawSetString("space", lua.LString(client.space))
+	t.RawSetString("role", lua.LString(client.role))
+	t.RawSetString("team", lua.LString(client.team))
+	return t
+}
+
+// envelopeTable converts the fields of e Lua modules can read and change.
+func (r *LuaRuntime) envelopeTable(e *server.Envelope) *lua.LTable {
+	t := r.L.NewTable()
+	t.RawSetString("collation_id", lua.LString(e.CollationId))
+	if rpc := e.GetRpc(); rpc != nil {
+		t.RawSetString("rpc_id", lua.LString(rpc.Id))
+		t.RawSetString("payload", lua.LString(rpc.Payload))
+	}
+	if sp := e.GetSpacePresence(); sp != nil {
+		changes := r.L.NewTable()
+		for _, entity := range sp.Changes {
+			et := r.L.NewTable()
+			et.RawSetString("id", lua.LString(entity.Id))
+			et.RawSetString("user_id", lua.LString(entity.UserId))
+			if p := entity.Position; p != nil {
+				et.RawSetString("x", lua.LNumber(p.X))
+				et.RawSetString("y", lua.LNumber(p.Y))
+				et.RawSetString("z", lua.LNumber(p.Z))
+			}
+			changes.Append(et)
+		}
+		t.RawSetString("changes", changes)
+	}
+	return t
+}
+
+// applyEnvelopeTable copies the rpc payload and entity positions of t back
+// to e.
+func applyEnvelopeTable(t *lua.LTable, e *server.Envelope) {
+	if rpc := e.GetRpc(); rpc != nil {
+		rpc.Payload = lua.LVAsString(t.RawGetString("payload"))
+	}
+	if sp := e.GetSpacePresence(); sp != nil {
+		changes, ok := t.RawGetString("changes").(*lua.LTable)
+		if !ok {
+			return
+		}
+		for i, entity := range sp.Changes {
+			et, ok := changes.RawGetInt(i + 1).(*lua.LTable)
+			if !ok || entity.Position == nil {
+				continue
+			}
+			entity.Position.X = float32(lua.LVAsNumber(et.RawGetString("x")))
+			entity.Position.Y = float32(lua.LVAsNumber(et.RawGetString("y")))
+			entity.Position.Z = float32(lua.LVAsNumber(et.RawGetString("z")))
+		}
+	}
+}
+
+func (r *LuaRuntime) OnConnect(client *Client) error {
+	for _, fn := range r.hooks[luaHookConnect] {
+		ret, err := r.call(fn, r.clientTable(client))
+		if err != nil {
+			return err
+		}
+		if ret == lua.LFalse {
+			return errors.New("rejected by " + luaHookConnect + " hook")
+		}
+	}
+	return r.next.OnConnect(client)
+}
+
+func (r *LuaRuntime) OnDisconnect(client *Client) {
+	for _, fn := range r.hooks[luaHookDisconnect] {
+		if _, err := r.call(fn, r.clientTable(client)); err != nil {
+			log.Printf("lua: %s hook: %v", luaHookDisconnect, err)
+		}
+	}
+	r.next.OnDisconnect(client)
+}
+
+// BeforeBroadcast drops e if a hook returns false. Hooks may change the rpc
+// payload or the entity positions of the envelope table they get.
+func (r *LuaRuntime) BeforeBroadcast(sender *Client, e *server.Envelope) (*server.Envelope, bool) {
+	for _, fn := range r.hooks[luaHookBeforeBroadcast] {
+		t := r.envelopeTable(e)
+		ret, err := r.call(fn, r.clientTable(sender), t)
+		if err != nil {
+			log.Printf("lua: %s hook: %v", luaHookBeforeBroadcast, err)
+			continue
+		}
+		if ret == lua.LFalse {
+			return nil, false
+		}
+		applyEnvelopeTable(t, e)
+	}
+	return r.next.BeforeBroadcast(sender, e)
+}
+
+func (r *LuaRuntime) AfterBroadcast(sender *Client, e *server.Envelope) {
+	if fns := r.hooks[luaHookAfterBroadcast]; len(fns) > 0 {
+		t := r.envelopeTable(e)
+		for _, fn := range fns {
+			if _, err := r.call(fn, r.clientTable(sender), t); err != nil {
+				log.Printf("lua: %s hook: %v", luaHookAfterBroadcast, err)
+			}
+		}
+	}
+	r.next.AfterBroadcast(sender, e)
+}
+
+// OnZoneEvent calls the zone_enter or zone_exit hooks with the client, the
+// zone id and the entity id.
+func (r *LuaRuntime) OnZoneEvent(client *Client, event *ZoneEvent) {
+	hook := luaHookZoneExit
+	if event.Event == ZoneEnter {
+		hook = luaHookZoneEnter
+	}
+	for _, fn := range r.hooks[hook] {
+		if _, err := r.call(fn, r.clientTable(client), lua.LString(event.Zone), lua.LString(event.EntityID)); err != nil {
+			log.Printf("lua: %s hook: %v", hook, err)
+		}
+	}
+	if next, ok := r.next.(ZoneHooks); ok {
+		next.OnZoneEvent(client, event)
+	}
+}
+
+func (r *LuaRuntime) OnRPC(client *Client, id, payload string) (string, error) {
+	fn, ok := r.rpcs[id]
+	if !ok {
+		return r.next.OnRPC(client, id, payload)
+	}
+	ret, err := r.call(fn, lua.LString(client.id), lua.LString(payload))
+	if err != nil {
+		return "", err
+	}
+	return lua.LVAsString(ret), nil
+}
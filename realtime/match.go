@@ -0,0 +1,383 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"nakama/server"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// Rpc ids of authoritative matches. Clients send match_create,
+	// match_join and match_leave; the server answers each on the same
+	// collation id and sends match_ended when a match terminates.
+	rpcMatchCreate = "match_create"
+	rpcMatchJoin   = "match_join"
+	rpcMatchLeave  = "match_leave"
+	rpcMatchEnded  = "match_ended"
+
+	// Size of the input, join and leave queues of a match.
+	matchQueueSize = 256
+
+	// Most ticks per second of a match.
+	maxMatchTickRate = 1000
+)
+
+// errMatchSpace refuses the clients connecting with the id of a match as
+// space. They would get the match messages without the handler deciding.
+var errMatchSpace = errors.New("join matches with match_join")
+
+// MatchPresence is a client in a match.
+type MatchPresence struct {
+	UserID string
+
+	client *Client
+}
+
+// MatchMessage is an envelope sent by a match member.
+type MatchMessage struct {
+	Sender     *MatchPresence
+	Envelope   *server.Envelope
+	ReceivedAt time.Time
+}
+
+// MatchDispatcher sends messages from a match handler to the clients.
+type MatchDispatcher interface {
+	// Broadcast sends e to the presences, or to every member if presences
+	// is nil.
+	Broadcast(e *server.Envelope, presences []*MatchPresence)
+
+	// Kick removes the presences from the match.
+	Kick(presences []*MatchPresence)
+}
+
+// MatchHandler implements the logic of an authoritative match. A match owns
+// its state and runs in its own goroutine: the methods of a handler are never
+// called concurrently for the same match. Returning a nil state from any
+// method but MatchInit and MatchTerminate ends the match.
+type MatchHandler interface {
+	// MatchInit returns the initial state, the number of ticks per second
+	// and a label describing the match.
+	MatchInit(params map[string]interface{}) (state interface{}, tickRate int, label string)
+
+	// MatchJoinAttempt decides whether the presence may join, and why not.
+	MatchJoinAttempt(tick int64, state interface{}, dispatcher MatchDispatcher, presence *MatchPresence) (interface{}, bool, string)
+
+	// MatchJoin is called once the presences joined.
+	MatchJoin(tick int64, state interface{}, dispatcher MatchDispatcher, presences []*MatchPresence) interface{}
+
+	// MatchLeave is called once the presences left.
+	MatchLeave(tick int64, state interface{}, dispatcher MatchDispatcher, presences []*MatchPresence) interface{}
+
+	// MatchLoop is called every tick with the messages received since the
+	// previous tick.
+	MatchLoop(tick int64, state interface{}, dispatcher MatchDispatcher, messages []*MatchMessage) interface{}
+
+	// MatchTerminate is called when the match ends, whether a method
+	// returned a nil state or the hub stopped, with the last state that was
+	// not nil.
+	MatchTerminate(tick int64, state interface{}, dispatcher MatchDispatcher)
+}
+
+// matchRequest is the json payload of the match rpcs sent by clients.
+type matchRequest struct {
+	MatchID string                 `json:"match_id"`
+	Handler string                 `json:"handler"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+// matchInfo is the json payload of the answers to the match rpcs and of
+// match_ended.
+type matchInfo struct {
+	MatchID string `json:"match_id"`
+	Label   string `json:"label"`
+}
+
+type matchJoin struct {
+	presence    *MatchPresence
+	collationID string
+}
+
+// matchJoinResult is sent by a match to the hub once a join attempt is
+// decided.
+type matchJoinResult struct {
+	match  *match
+	join   *matchJoin
+	ok     bool
+	reason string
+}
+
+// matchOutput is a message sent by a match handler, delivered by the hub to
+// the targets still in the match.
+type matchOutput struct {
+	match    *match
+	envelope *server.Envelope
+	targets  []*MatchPresence
+	kick     bool
+}
+
+type match struct {
+	id      string
+	label   string
+	hub     *Hub
+	handler MatchHandler
+
+	tickRate int
+	state    interface{}
+
+	input  chan *MatchMessage
+	joins  chan *matchJoin
+	leaves chan *Client
+	stop   chan struct{}
+
+	// Closed once the match stops reading its queues.
+	done chan struct{}
+
+	// Members by client, owned by the match goroutine.
+	presences map[*Client]*MatchPresence
+
+	// Clients the match accepted and that did not leave, owned by the hub
+	// goroutine. Only they get the match messages.
+	members map[*Client]bool
+}
+
+func (m *match) Broadcast(e *server.Envelope, presences []*MatchPresence) {
+	m.output(&matchOutput{match: m, envelope: e, targets: presences})
+}
+
+func (m *match) Kick(presences []*MatchPresence) {
+	m.output(&matchOutput{match: m, targets: presences, kick: true})
+}
+
+func (m *match) output(output *matchOutput) {
+	select {
+	case m.hub.matchOutputs <- output:
+	case <-m.hub.quit:
+	}
+}
+
+func (m *match) run() {
+	ticker := time.NewTicker(time.Second / time.Duration(m.tickRate))
+	defer ticker.Stop()
+	var tick int64
+	var messages []*MatchMessage
+	var last interface{}
+	for m.state != nil {
+		last = m.state
+		select {
+		case join := <-m.joins:
+			state, ok, reason := m.handler.MatchJoinAttempt(tick, m.state, m, join.presence)
+			if m.state = state; state == nil {
+				ok, reason = false, "match ended"
+			}
+			select {
+			case m.hub.matchJoins <- &matchJoinResult{match: m, join: join, ok: ok, reason: reason}:
+			case <-m.hub.quit:
+			}
+			if ok {
+				last = m.state
+				m.presences[join.presence.client] = join.presence
+				m.state = m.handler.MatchJoin(tick, m.state, m, []*MatchPresence{join.presence})
+			}
+		case client := <-m.leaves:
+			if p, ok := m.presences[client]; ok {
+				delete(m.presences, client)
+				m.state = m.handler.MatchLeave(tick, m.state, m, []*MatchPresence{p})
+			}
+		case message := <-m.input:
+			if p, ok := m.presences[message.Sender.client]; ok {
+				message.Sender = p
+				messages = append(messages, message)
+			}
+		case <-ticker.C:
+			tick++
+			m.state = m.handler.MatchLoop(tick, m.state, m, messages)
+			messages = nil
+		case <-m.stop:
+			m.state = nil
+		}
+	}
+	close(m.done)
+	m.handler.MatchTerminate(tick, last, m)
+	select {
+	case m.hub.matchEnded <- m:
+	case <-m.hub.quit:
+	}
+}
+
+// createMatch handles a match_create rpc. The match starts empty, the
+// creator joins it with match_join like everyone else.
+func (h *Hub) createMatch(message *MessageEnvelope, e *server.Envelope) {
+	req := &matchRequest{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return
+	}
+	newHandler, ok := h.matchHandlers[req.Handler]
+	if !ok {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, "unknown match handler "+req.Handler))
+		return
+	}
+	handler := newHandler()
+	state, tickRate, label := handler.MatchInit(req.Params)
+	if state == nil || tickRate <= 0 || tickRate > maxMatchTickRate {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "match init failed"))
+		return
+	}
+	m := &match{
+		id:        uuid.NewV4().String(),
+		label:     label,
+		hub:       h,
+		handler:   handler,
+		tickRate:  tickRate,
+		state:     state,
+		input:     make(chan *MatchMessage, matchQueueSize),
+		joins:     make(chan *matchJoin, matchQueueSize),
+		leaves:    make(chan *Client, matchQueueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		presences: make(map[*Client]*MatchPresence),
+		members:   make(map[*Client]bool),
+	}
+	h.matches[m.id] = m
+	go m.run()
+	h.send(message.sender, rpcEnvelope(rpcMatchCreate, e.CollationId, &matchInfo{MatchID: m.id, Label: label}))
+}
+
+// joinMatch handles a match_join rpc. The answer is sent once the match
+// decided on the join attempt.
+func (h *Hub) joinMatch(message *MessageEnvelope, e *server.Envelope) {
+	req := &matchRequest{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return
+	}
+	m, ok := h.matches[req.MatchID]
+	if !ok {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, "unknown match "+req.MatchID))
+		return
+	}
+	join := &matchJoin{
+		presence:    &MatchPresence{UserID: message.sender.id, client: message.sender},
+		collationID: e.CollationId,
+	}
+	select {
+	case m.joins <- join:
+	default:
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "match is busy"))
+	}
+}
+
+// leaveMatch handles a match_leave rpc.
+func (h *Hub) leaveMatch(message *MessageEnvelope, e *server.Envelope) {
+	if m, ok := h.matches[message.sender.space]; ok {
+		h.moveSpace(message.sender, "")
+		h.send(message.sender, rpcEnvelope(rpcMatchLeave, e.CollationId, &matchInfo{MatchID: m.id, Label: m.label}))
+	}
+}
+
+// leave tells the match the client left. It waits for room in the leave
+// queue, delivering the match outputs meanwhile as the match may be waiting
+// on the hub, so MatchLeave runs for every member.
+func (h *Hub) leave(m *match, client *Client) {
+	delete(m.members, client)
+	for {
+		select {
+		case m.leaves <- client:
+			return
+		case output := <-h.matchOutputs:
+			h.handleMatchOutput(output)
+		case result := <-h.matchJoins:
+			h.handleMatchJoin(result)
+		case <-m.done:
+			return
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// routeToMatch queues an envelope of a match member on the input of the
+// match. It reports whether the sender is in a match.
+func (h *Hub) routeToMatch(message *MessageEnvelope, e *server.Envelope) bool {
+	m, ok := h.matches[message.sender.space]
+	if !ok {
+		return false
+	}
+	if e != nil {
+		select {
+		case m.input <- &MatchMessage{
+			Sender:     &MatchPresence{UserID: message.sender.id, client: message.sender},
+			Envelope:   e,
+			ReceivedAt: message.receivedAt,
+		}:
+		default:
+		}
+	}
+	return true
+}
+
+func (h *Hub) handleMatchJoin(result *matchJoinResult) {
+	client := result.join.presence.client
+	if !h.clients[client] {
+		// The client left while the match decided.
+		h.leave(result.match, client)
+		return
+	}
+	if !result.ok {
+		h.send(client, errorEnvelope(result.join.collationID, errCodeRejected, result.reason))
+		return
+	}
+	h.moveSpace(client, result.match.id)
+	result.match.members[client] = true
+	h.send(client, rpcEnvelope(rpcMatchJoin, result.join.collationID, &matchInfo{MatchID: result.match.id, Label: result.match.label}))
+}
+
+func (h *Hub) handleMatchOutput(output *matchOutput) {
+	f := &frame{}
+	if output.envelope != nil {
+		var err error
+		if f.data, err = marshal(output.envelope); err != nil {
+			return
+		}
+	}
+	deliver := func(client *Client) {
+		if !output.match.members[client] {
+			return
+		}
+		if output.kick {
+			h.moveSpace(client, "")
+			h.send(client, rpcEnvelope(rpcMatchEnded, "", &matchInfo{MatchID: output.match.id, Label: output.match.label}))
+			return
+		}
+		client.send.push(laneReliable, f.dataFor(client))
+	}
+	if output.targets == nil {
+		for client := range h.clients {
+			deliver(client)
+		}
+		return
+	}
+	for _, p := range output.targets {
+		if h.clients[p.client] {
+			deliver(p.client)
+		}
+	}
+}
+
+func (h *Hub) handleMatchEnded(m *match) {
+	delete(h.matches, m.id)
+	for client := range h.clients {
+		if client.space == m.id {
+			h.moveSpace(client, "")
+			h.send(client, rpcEnvelope(rpcMatchEnded, "", &matchInfo{MatchID: m.id, Label: m.label}))
+		}
+	}
+}
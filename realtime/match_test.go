@@ -0,0 +1,121 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestMatch returns a match of the hub that is not running.
+func newTestMatch(h *Hub, id string) *match {
+	m := &match{
+		id:        id,
+		hub:       h,
+		leaves:    make(chan *Client, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		presences: make(map[*Client]*MatchPresence),
+		members:   make(map[*Client]bool),
+	}
+	h.matches[id] = m
+	return m
+}
+
+func TestHandleMatchOutput(t *testing.T) {
+	member := &Client{id: "member", space: "m", send: newSendQueue()}
+	// In the space of the match without joining it.
+	stowaway := &Client{id: "stowaway", space: "m", send: newSendQueue()}
+	h := &Hub{
+		clients: map[*Client]bool{member: true, stowaway: true},
+		matches: make(map[string]*match),
+	}
+	m := newTestMatch(h, "m")
+	m.members[member] = true
+	h.handleMatchOutput(&matchOutput{match: m, envelope: rpcEnvelope("state", "", nil)})
+	if n := member.send.len(); n != 1 {
+		t.Errorf("member got %d messages, want 1", n)
+	}
+	if n := stowaway.send.len(); n != 0 {
+		t.Errorf("client outside the match got %d messages, want 0", n)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	tests := []struct {
+		name string
+		// Leaves queued before, filling the queue.
+		full bool
+		// Whether the match stopped reading its queues.
+		done bool
+	}{
+		{"room in the queue", false, false},
+		{"match stopped", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{id: "a", space: "m", send: newSendQueue()}
+			h := &Hub{
+				clients: map[*Client]bool{client: true},
+				matches: make(map[string]*match),
+				quit:    make(chan struct{}),
+			}
+			m := newTestMatch(h, "m")
+			m.members[client] = true
+			if tt.full {
+				m.leaves <- &Client{}
+			}
+			if tt.done {
+				close(m.done)
+			}
+			left := make(chan struct{})
+			go func() {
+				h.leave(m, client)
+				close(left)
+			}()
+			select {
+			case <-left:
+			case <-time.After(time.Second):
+				t.Fatal("leave blocked")
+			}
+			if m.members[client] {
+				t.Error("client still a member")
+			}
+			if !tt.full && len(m.leaves) != 1 {
+				t.Error("leave not queued")
+			}
+		})
+	}
+}
+
+func TestLeaveWaitsForRoom(t *testing.T) {
+	client := &Client{id: "a", space: "m", send: newSendQueue()}
+	h := &Hub{
+		clients: map[*Client]bool{client: true},
+		matches: make(map[string]*match),
+		quit:    make(chan struct{}),
+	}
+	m := newTestMatch(h, "m")
+	m.members[client] = true
+	other := &Client{}
+	m.leaves <- other
+	left := make(chan struct{})
+	go func() {
+		h.leave(m, client)
+		close(left)
+	}()
+	select {
+	case <-left:
+		t.Fatal("leave returned while the queue was full")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if got := <-m.leaves; got != other {
+		t.Fatal("queued leave lost")
+	}
+	<-left
+	if got := <-m.leaves; got != client {
+		t.Error("leave dropped")
+	}
+}
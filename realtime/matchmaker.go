@@ -0,0 +1,254 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"nakama/server"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// Rpc ids of the matchmaker. Clients send matchmaker_add and
+	// matchmaker_remove; the server answers matchmaker_add with
+	// matchmaker_ticket and later sends matchmaker_matched or
+	// matchmaker_timeout for the ticket.
+	rpcMatchmakerAdd     = "matchmaker_add"
+	rpcMatchmakerRemove  = "matchmaker_remove"
+	rpcMatchmakerTicket  = "matchmaker_ticket"
+	rpcMatchmakerMatched = "matchmaker_matched"
+	rpcMatchmakerTimeout = "matchmaker_timeout"
+
+	// Time between two matchmaking passes.
+	matchmakerInterval = time.Second
+)
+
+// matchQuery is what a ticket requires from the other tickets of its match.
+type matchQuery struct {
+	// Accepted number of players in the match, the ticket included. Zero
+	// means no limit.
+	MinCount int `json:"min_count"`
+	MaxCount int `json:"max_count"`
+
+	// Inclusive ranges the numeric properties of the others must be in.
+	Numeric map[string]numericRange `json:"numeric"`
+
+	// Values the string properties of the others must be equal to.
+	Strings map[string]string `json:"strings"`
+}
+
+type numericRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// matchmakerAdd is the json payload of a matchmaker_add rpc. Properties
+// values are numbers or strings.
+type matchmakerAdd struct {
+	Properties map[string]interface{} `json:"properties"`
+	Query      matchQuery             `json:"query"`
+}
+
+// matchmakerTicket is the json payload of the matchmaker_ticket,
+// matchmaker_remove and matchmaker_timeout rpcs.
+type matchmakerTicket struct {
+	Ticket string `json:"ticket"`
+}
+
+// matchmakerMatched is the json payload of a matchmaker_matched rpc. The
+// members have been moved to the space of the match.
+type matchmakerMatched struct {
+	Ticket  string   `json:"ticket"`
+	MatchID string   `json:"match_id"`
+	Space   string   `json:"space"`
+	Users   []string `json:"users"`
+}
+
+type ticket struct {
+	id         string
+	client     *Client
+	properties map[string]interface{}
+	query      matchQuery
+	createdAt  time.Time
+}
+
+// accepts reports whether other satisfies the query of t.
+func (t *ticket) accepts(other *ticket) bool {
+	for key, r := range t.query.Numeric {
+		v, ok := other.properties[key].(float64)
+		if !ok || v < r.Min || v > r.Max {
+			return false
+		}
+	}
+	for key, want := range t.query.Strings {
+		v, ok := other.properties[key].(string)
+		if !ok || v != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Matchmaker holds the tickets of the clients waiting for a match. It is
+// owned by the hub goroutine.
+type Matchmaker struct {
+	// Time after which a ticket expires, zero or less for never.
+	timeout time.Duration
+	tickets map[string]*ticket
+}
+
+func newMatchmaker(timeout time.Duration) *Matchmaker {
+	return &Matchmaker{
+		timeout: timeout,
+		tickets: make(map[string]*ticket),
+	}
+}
+
+// removeClient cancels the tickets of the client.
+func (m *Matchmaker) removeClient(client *Client) {
+	for id, t := range m.tickets {
+		if t.client == client {
+			delete(m.tickets, id)
+		}
+	}
+}
+
+// waiting returns the tickets oldest first.
+func (m *Matchmaker) waiting() []*ticket {
+	tickets := make([]*ticket, 0, len(m.tickets))
+	for _, t := range m.tickets {
+		tickets = append(tickets, t)
+	}
+	sort.Slice(tickets, func(i, j int) bool {
+		return tickets[i].createdAt.Before(tickets[j].createdAt)
+	})
+	return tickets
+}
+
+// match greedily groups the waiting tickets, oldest first. Every member of a
+// group accepts every other member, belongs to another client, and the group
+// size is within the count limits of all members.
+func (m *Matchmaker) match() [][]*ticket {
+	var matches [][]*ticket
+	used := make(map[*ticket]bool)
+	tickets := m.waiting()
+	for i, first := range tickets {
+		if used[first] {
+			continue
+		}
+		group := []*ticket{first}
+		clients := map[*Client]bool{first.client: true}
+		minCount, maxCount := first.query.MinCount, first.query.MaxCount
+		for _, candidate := range tickets[i+1:] {
+			if used[candidate] || clients[candidate.client] {
+				continue
+			}
+			if maxCount > 0 && len(group) >= maxCount {
+				break
+			}
+			if candidate.query.MaxCount > 0 && len(group) >= candidate.query.MaxCount {
+				continue
+			}
+			compatible := true
+			for _, member := range group {
+				if !member.accepts(candidate) || !candidate.accepts(member) {
+					compatible = false
+					break
+				}
+			}
+			if !compatible {
+				continue
+			}
+			group = append(group, candidate)
+			clients[candidate.client] = true
+			if candidate.query.MinCount > minCount {
+				minCount = candidate.query.MinCount
+			}
+			if candidate.query.MaxCount > 0 && (maxCount == 0 || candidate.query.MaxCount < maxCount) {
+				maxCount = candidate.query.MaxCount
+			}
+		}
+		if len(group) < 2 || len(group) < minCount {
+			continue
+		}
+		for _, t := range group {
+			used[t] = true
+		}
+		matches = append(matches, group)
+	}
+	return matches
+}
+
+// addTicket handles a matchmaker_add rpc.
+func (h *Hub) addTicket(message *MessageEnvelope, e *server.Envelope) {
+	req := &matchmakerAdd{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return
+	}
+	t := &ticket{
+		id:         uuid.NewV4().String(),
+		client:     message.sender,
+		properties: req.Properties,
+		query:      req.Query,
+		createdAt:  time.Now(),
+	}
+	h.matchmaker.tickets[t.id] = t
+	h.send(message.sender, rpcEnvelope(rpcMatchmakerTicket, e.CollationId, &matchmakerTicket{Ticket: t.id}))
+}
+
+// removeTicket handles a matchmaker_remove rpc.
+func (h *Hub) removeTicket(message *MessageEnvelope, e *server.Envelope) {
+	req := &matchmakerTicket{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return
+	}
+	if t, ok := h.matchmaker.tickets[req.Ticket]; ok && t.client == message.sender {
+		delete(h.matchmaker.tickets, req.Ticket)
+	}
+	h.send(message.sender, rpcEnvelope(rpcMatchmakerRemove, e.CollationId, req))
+}
+
+// matchmake drops the tickets of unregistered clients and expires the old
+// ones, then moves every group of matched tickets to a new space and notifies
+// its members.
+func (h *Hub) matchmake() {
+	m := h.matchmaker
+	now := time.Now()
+	for id, t := range m.tickets {
+		if !h.clients[t.client] {
+			// A ticket added by a message read before its sender left.
+			delete(m.tickets, id)
+			continue
+		}
+		if m.timeout > 0 && now.Sub(t.createdAt) > m.timeout {
+			delete(m.tickets, id)
+			h.send(t.client, rpcEnvelope(rpcMatchmakerTimeout, "", &matchmakerTicket{Ticket: id}))
+		}
+	}
+	for _, group := range m.match() {
+		matchID := uuid.NewV4().String()
+		users := make([]string, 0, len(group))
+		for _, t := range group {
+			users = append(users, t.client.id)
+		}
+		for _, t := range group {
+			delete(m.tickets, t.id)
+			m.removeClient(t.client)
+			h.moveSpace(t.client, matchID)
+			h.send(t.client, rpcEnvelope(rpcMatchmakerMatched, "", &matchmakerMatched{
+				Ticket:  t.id,
+				MatchID: matchID,
+				Space:   matchID,
+				Users:   users,
+			}))
+		}
+	}
+}
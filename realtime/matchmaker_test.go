@@ -0,0 +1,130 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describeGroups lists the client ids of each group.
+func describeGroups(groups [][]*ticket) []string {
+	var list []string
+	for _, group := range groups {
+		var ids []string
+		for _, t := range group {
+			ids = append(ids, t.client.id)
+		}
+		list = append(list, strings.Join(ids, " "))
+	}
+	return list
+}
+
+func TestMatch(t *testing.T) {
+	type add struct {
+		client     string
+		properties map[string]interface{}
+		query      matchQuery
+	}
+	level := func(v float64) map[string]interface{} { return map[string]interface{}{"level": v} }
+	near := matchQuery{Numeric: map[string]numericRange{"level": {Min: 1, Max: 5}}}
+	tests := []struct {
+		name string
+		adds []add
+		want []string
+	}{
+		{"pair", []add{{client: "a"}, {client: "b"}}, []string{"a b"}},
+		{"alone", []add{{client: "a"}}, nil},
+		{"same client", []add{{client: "a"}, {client: "a"}}, nil},
+		{"same client after another", []add{{client: "a"}, {client: "b"}, {client: "b"}}, []string{"a b"}},
+		{"max count", []add{{client: "a", query: matchQuery{MaxCount: 2}}, {client: "b"}, {client: "c"}}, []string{"a b"}},
+		{"min count unmet", []add{{client: "a", query: matchQuery{MinCount: 3}}, {client: "b"}}, nil},
+		{"min count of a candidate", []add{{client: "a"}, {client: "b", query: matchQuery{MinCount: 3}}, {client: "c"}}, []string{"a b c"}},
+		{"numeric range", []add{
+			{"a", level(3), near},
+			{"b", level(9), near},
+			{"c", level(4), near},
+		}, []string{"a c"}},
+		{"strings", []add{
+			{"a", map[string]interface{}{"mode": "duel"}, matchQuery{Strings: map[string]string{"mode": "duel"}}},
+			{"b", map[string]interface{}{"mode": "race"}, matchQuery{}},
+			{"c", map[string]interface{}{"mode": "duel"}, matchQuery{}},
+		}, []string{"a c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMatchmaker(0)
+			clients := make(map[string]*Client)
+			start := time.Now()
+			for i, a := range tt.adds {
+				client, ok := clients[a.client]
+				if !ok {
+					client = &Client{id: a.client}
+					clients[a.client] = client
+				}
+				id := fmt.Sprint("t", i)
+				m.tickets[id] = &ticket{id: id, client: client, properties: a.properties, query: a.query, createdAt: start.Add(time.Duration(i) * time.Millisecond)}
+			}
+			if got := describeGroups(m.match()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchmakeTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		age     time.Duration
+		want    bool
+	}{
+		{"no timeout", 0, time.Hour, true},
+		{"negative timeout", -time.Second, time.Hour, true},
+		{"within timeout", time.Minute, time.Second, true},
+		{"expired", time.Minute, time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{id: "a", send: newSendQueue()}
+			h := &Hub{
+				clients:    map[*Client]bool{client: true},
+				matchmaker: newMatchmaker(tt.timeout),
+			}
+			h.matchmaker.tickets["t"] = &ticket{id: "t", client: client, createdAt: time.Now().Add(-tt.age)}
+			h.matchmake()
+			if _, kept := h.matchmaker.tickets["t"]; kept != tt.want {
+				t.Errorf("ticket kept = %v, want %v", kept, tt.want)
+			}
+			if told := client.send.len() > 0; told == tt.want {
+				t.Errorf("client told of the timeout = %v, want %v", told, !tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchmakeMovesGroups(t *testing.T) {
+	a := &Client{id: "a", space: "lobby", send: newSendQueue()}
+	b := &Client{id: "b", space: "lobby", send: newSendQueue()}
+	h := &Hub{
+		clients:      map[*Client]bool{a: true, b: true},
+		matchmaker:   newMatchmaker(0),
+		entityOwners: make(map[entityKey]*entityOwner),
+	}
+	now := time.Now()
+	h.matchmaker.tickets["t1"] = &ticket{id: "t1", client: a, createdAt: now}
+	h.matchmaker.tickets["t2"] = &ticket{id: "t2", client: b, createdAt: now.Add(time.Millisecond)}
+	h.matchmaker.tickets["t3"] = &ticket{id: "t3", client: b, createdAt: now.Add(2 * time.Millisecond)}
+	h.matchmake()
+	if a.space == "lobby" || a.space != b.space {
+		t.Errorf("spaces %q and %q, want the same new space", a.space, b.space)
+	}
+	if n := len(h.matchmaker.tickets); n != 0 {
+		t.Errorf("%d tickets left, want 0", n)
+	}
+}
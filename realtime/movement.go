@@ -0,0 +1,145 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"nakama/server"
+)
+
+// Key of the movement rules applying to the spaces without rules of their
+// own.
+const AnySpace = "*"
+
+const kickReason = "too many movement violations"
+
+// MovementRules limit how the entities of a space may move. Zero values
+// disable a rule.
+type MovementRules struct {
+	// Maximum distance per second between two updates of an entity. One
+	// tick is added to the time between them to allow for network jitter.
+	MaxSpeed float32
+
+	// Opposite corners of the box entities must stay in. The bounds are not
+	// checked if Min equals Max.
+	Min, Max Vec3
+
+	// Maximum distance between two updates of an entity, however long
+	// apart they are.
+	MaxStep float32
+
+	// Drop the updates breaking a rule rather than moving them to the
+	// nearest allowed position.
+	Reject bool
+
+	// Number of violations after which a client is kicked.
+	KickAfter int
+}
+
+// entityMove is the last accepted position of an entity.
+type entityMove struct {
+	position Vec3
+	at       time.Time
+}
+
+// movementRules returns the rules of the space, nil if there are none.
+func (h *Hub) movementRules(space string) *MovementRules {
+	if rules, ok := h.movement[space]; ok {
+		return rules
+	}
+	return h.movement[AnySpace]
+}
+
+// validateMovement checks the entities of sp against the rules of the
+// sender's space and their last accepted position. Violating entities are
+// clamped or dropped, and the sender gets a SpacePresence with the positions
+// the server kept. It reports false if the sender was kicked.
+func (h *Hub) validateMovement(message *MessageEnvelope, sp *server.SpacePresence) bool {
+	rules := h.movementRules(message.sender.space)
+	if rules == nil {
+		return true
+	}
+	var corrections []*server.Entity
+	changes := sp.Changes[:0]
+	for _, e := range sp.Changes {
+		if e.Position == nil {
+			changes = append(changes, e)
+			continue
+		}
+		position := vec3From(e.Position)
+		key := entityKey{message.sender.space, e.Id}
+		last, known := h.moves[key]
+		allowed := rules.clamp(position, last, known, message.receivedAt)
+		if allowed == position {
+			h.moves[key] = entityMove{position, message.receivedAt}
+			changes = append(changes, e)
+			continue
+		}
+		message.sender.violations++
+		if rules.Reject {
+			if known {
+				corrections = append(corrections, &server.Entity{Id: e.Id, UserId: e.UserId, Position: last.position.V3()})
+			}
+			continue
+		}
+		h.moves[key] = entityMove{allowed, message.receivedAt}
+		e.Position = allowed.V3()
+		corrections = append(corrections, &server.Entity{Id: e.Id, UserId: e.UserId, Position: allowed.V3()})
+		changes = append(changes, e)
+	}
+	sp.Changes = changes
+	if rules.KickAfter > 0 && message.sender.violations >= rules.KickAfter {
+		h.send(message.sender, errorEnvelope("", errCodeRejected, kickReason))
+		message.sender.closeCode = websocket.ClosePolicyViolation
+		message.sender.closeReason = kickReason
+		h.remove(message.sender)
+		return false
+	}
+	if len(corrections) > 0 {
+		h.send(message.sender, rpcEnvelope(rpcServerTick, "", message.tick))
+		h.send(message.sender, &server.Envelope{Payload: &server.Envelope_SpacePresence{
+			SpacePresence: &server.SpacePresence{Changes: corrections},
+		}})
+	}
+	return true
+}
+
+// clamp returns the nearest position to p the rules allow, coming from last
+// if known.
+func (r *MovementRules) clamp(p Vec3, last entityMove, known bool, at time.Time) Vec3 {
+	if known {
+		var limit float32 = -1
+		if r.MaxSpeed > 0 {
+			limit = r.MaxSpeed * float32((at.Sub(last.at) + tickPeriod).Seconds())
+		}
+		if r.MaxStep > 0 && (limit < 0 || r.MaxStep < limit) {
+			limit = r.MaxStep
+		}
+		step := p.sub(last.position)
+		if d := step.length(); limit >= 0 && d > limit {
+			p = last.position.add(step.scale(limit / d))
+		}
+	}
+	if r.Min != r.Max {
+		p = Vec3{clampf(p.X, r.Min.X, r.Max.X), clampf(p.Y, r.Min.Y, r.Max.Y), clampf(p.Z, r.Min.Z, r.Max.Z)}
+	}
+	return p
+}
+
+func clampf(v, min, max float32) float32 {
+	if min > max {
+		min, max = max, min
+	}
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,44 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClamp(t *testing.T) {
+	at := time.Now()
+	// One second minus the tick allowed for jitter.
+	second := at.Add(-time.Second + tickPeriod)
+	tests := []struct {
+		name  string
+		rules MovementRules
+		p     Vec3
+		last  entityMove
+		known bool
+		want  Vec3
+	}{
+		{"no rules", MovementRules{}, Vec3{100, 0, 0}, entityMove{Vec3{}, second}, true, Vec3{100, 0, 0}},
+		{"within speed", MovementRules{MaxSpeed: 10}, Vec3{5, 0, 0}, entityMove{Vec3{}, second}, true, Vec3{5, 0, 0}},
+		{"over speed", MovementRules{MaxSpeed: 10}, Vec3{20, 0, 0}, entityMove{Vec3{}, second}, true, Vec3{10, 0, 0}},
+		{"speed along the step", MovementRules{MaxSpeed: 5}, Vec3{6, 8, 0}, entityMove{Vec3{}, second}, true, Vec3{3, 4, 0}},
+		{"first update not limited", MovementRules{MaxSpeed: 10}, Vec3{20, 0, 0}, entityMove{}, false, Vec3{20, 0, 0}},
+		{"max step", MovementRules{MaxStep: 2}, Vec3{0, 0, 5}, entityMove{Vec3{}, second}, true, Vec3{0, 0, 2}},
+		{"max step under speed", MovementRules{MaxSpeed: 10, MaxStep: 4}, Vec3{8, 0, 0}, entityMove{Vec3{}, second}, true, Vec3{4, 0, 0}},
+		{"inside bounds", MovementRules{Min: Vec3{-1, -1, -1}, Max: Vec3{1, 1, 1}}, Vec3{0.5, 0, 0}, entityMove{}, false, Vec3{0.5, 0, 0}},
+		{"outside bounds", MovementRules{Min: Vec3{-1, -1, -1}, Max: Vec3{1, 1, 1}}, Vec3{3, -2, 0}, entityMove{}, false, Vec3{1, -1, 0}},
+		{"swapped bounds", MovementRules{Min: Vec3{1, 1, 1}, Max: Vec3{-1, -1, -1}}, Vec3{3, -2, 0}, entityMove{}, false, Vec3{1, -1, 0}},
+		{"speed then bounds", MovementRules{MaxSpeed: 10, Min: Vec3{0, 0, 0}, Max: Vec3{5, 5, 5}}, Vec3{20, 0, 0}, entityMove{Vec3{}, second}, true, Vec3{5, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rules.clamp(tt.p, tt.last, tt.known, at)
+			if got.sub(tt.want).length() > 1e-4 {
+				t.Errorf("clamp(%v) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/json"
+	"time"
+
+	"nakama/server"
+)
+
+// Policies deciding whether a client requesting an owned entity gets it.
+// Entities without an owner always go to the requester.
+const (
+	// The owner keeps the entity until it releases it, leaves the space or
+	// unregisters.
+	OwnershipFirstCome = "first_come"
+
+	// The entity goes to the requester once the owner has not updated it
+	// for OwnershipPolicy.Timeout.
+	OwnershipTimeout = "timeout"
+
+	// The entity goes to the requester if its authority is higher than
+	// the owner's.
+	OwnershipPriority = "priority"
+)
+
+const (
+	// Rpc ids a client sends to get or give up an entity.
+	rpcEntityRequest = "entity_request"
+	rpcEntityRelease = "entity_release"
+
+	// Rpc id of the ownership changes sent to the space.
+	rpcEntityOwner = "entity_owner"
+)
+
+// OwnershipPolicy decides who owns the entities requested by clients.
+type OwnershipPolicy struct {
+	// One of the Ownership constants. Empty means OwnershipFirstCome.
+	Policy string
+
+	// Time without updates after which an entity can be taken, with
+	// OwnershipTimeout.
+	Timeout time.Duration
+}
+
+// entityOwner is the client owning an entity, and when it last updated it.
+type entityOwner struct {
+	client  *Client
+	updated time.Time
+}
+
+// entityRequest is the json payload of the entity_request and entity_release
+// rpcs and of their replies.
+type entityRequest struct {
+	EntityID string `json:"entity_id"`
+	Granted  bool   `json:"granted"`
+	Owner    string `json:"owner"`
+}
+
+// entityOwnerChange is the json payload of an entity_owner rpc. Owner is
+// empty once the entity is released.
+type entityOwnerChange struct {
+	EntityID string `json:"entity_id"`
+	Owner    string `json:"owner"`
+	Previous string `json:"previous"`
+}
+
+// Authority returns the priority of the client for entities under
+// OwnershipPriority. Moderators start at 1, other clients at 0.
+func (c *Client) Authority() int {
+	return c.authority
+}
+
+// SetAuthority sets the priority of the client for entities under
+// OwnershipPriority. It must be called from the hub goroutine, such as in a
+// hook.
+func (c *Client) SetAuthority(authority int) {
+	c.authority = authority
+}
+
+// mayTake reports whether the policy gives the entity owned by owner to the
+// client at time now.
+func (p *OwnershipPolicy) mayTake(owner *entityOwner, client *Client, now time.Time) bool {
+	switch p.Policy {
+	case OwnershipTimeout:
+		return p.Timeout > 0 && now.Sub(owner.updated) >= p.Timeout
+	case OwnershipPriority:
+		return client.authority > owner.client.authority
+	}
+	return false
+}
+
+// requestEntity gives the entity of the sender's space to the sender if it
+// has no owner or the policy lets the sender take it.
+func (h *Hub) requestEntity(message *MessageEnvelope, e *server.Envelope) {
+	req := &entityRequest{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil || req.EntityID == "" {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, "missing entity_id"))
+		return
+	}
+	key := entityKey{message.sender.space, req.EntityID}
+	owner, owned := h.entityOwners[key]
+	switch {
+	case owned && owner.client == message.sender:
+		req.Granted = true
+	case !owned || h.ownership.mayTake(owner, message.sender, message.receivedAt):
+		req.Granted = true
+		h.setOwner(key, message.sender, message.receivedAt)
+		if owned {
+			h.resetEntity(key)
+		}
+	}
+	req.Owner = h.entityOwners[key].client.id
+	h.sendOn(message.sender, laneReliable, rpcEnvelope(rpcEntityRequest, e.CollationId, req))
+}
+
+// releaseEntity gives up an entity of the sender.
+func (h *Hub) releaseEntity(message *MessageEnvelope, e *server.Envelope) {
+	req := &entityRequest{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil || req.EntityID == "" {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, "missing entity_id"))
+		return
+	}
+	key := entityKey{message.sender.space, req.EntityID}
+	if owner, ok := h.entityOwners[key]; !ok || owner.client != message.sender {
+		h.send(message.sender, notOwnedError(e.CollationId, []string{req.EntityID}))
+		return
+	}
+	h.setOwner(key, nil, message.receivedAt)
+	h.resetEntity(key)
+	req.Granted = true
+	h.sendOn(message.sender, laneReliable, rpcEnvelope(rpcEntityRelease, e.CollationId, req))
+}
+
+// setOwner gives the entity to the client, nil to release it, and tells the
+// space of the entity.
+func (h *Hub) setOwner(key entityKey, client *Client, now time.Time) {
+	change := &entityOwnerChange{EntityID: key.id}
+	if previous, ok := h.entityOwners[key]; ok {
+		change.Previous = previous.client.id
+	}
+	if client != nil {
+		h.entityOwners[key] = &entityOwner{client: client, updated: now}
+		change.Owner = client.id
+	} else {
+		delete(h.entityOwners, key)
+	}
+	e := rpcEnvelope(rpcEntityOwner, "", change)
+	for c := range h.clients {
+		if c.space == key.space {
+			h.sendOn(c, laneReliable, e)
+		}
+	}
+}
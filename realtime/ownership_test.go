@@ -0,0 +1,110 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"nakama/server"
+)
+
+func TestMayTake(t *testing.T) {
+	now := time.Now()
+	owner := &Client{id: "o", authority: 1}
+	tests := []struct {
+		name      string
+		policy    OwnershipPolicy
+		authority int
+		updated   time.Duration
+		want      bool
+	}{
+		{"first come", OwnershipPolicy{}, 2, time.Hour, false},
+		{"timeout not reached", OwnershipPolicy{Policy: OwnershipTimeout, Timeout: time.Second}, 0, time.Second / 2, false},
+		{"timeout reached", OwnershipPolicy{Policy: OwnershipTimeout, Timeout: time.Second}, 0, time.Second, true},
+		{"timeout unset", OwnershipPolicy{Policy: OwnershipTimeout}, 0, time.Hour, false},
+		{"higher authority", OwnershipPolicy{Policy: OwnershipPriority}, 2, 0, true},
+		{"equal authority", OwnershipPolicy{Policy: OwnershipPriority}, 1, 0, false},
+		{"lower authority", OwnershipPolicy{Policy: OwnershipPriority}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &entityOwner{client: owner, updated: now.Add(-tt.updated)}
+			client := &Client{id: "c", authority: tt.authority}
+			if got := tt.policy.mayTake(o, client, now); got != tt.want {
+				t.Errorf("mayTake = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestEntity(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		policy    OwnershipPolicy
+		sender    string
+		entityID  string
+		wantOwner string
+		wantReset bool
+	}{
+		{"unowned", OwnershipPolicy{}, "player", "free", "player", false},
+		{"owned by the sender", OwnershipPolicy{}, "owner", "ball", "owner", false},
+		{"first come keeps it", OwnershipPolicy{}, "moderator", "ball", "owner", false},
+		{"taken by authority", OwnershipPolicy{Policy: OwnershipPriority}, "moderator", "ball", "moderator", true},
+		{"taken after timeout", OwnershipPolicy{Policy: OwnershipTimeout, Timeout: time.Second}, "player", "ball", "player", true},
+		{"own ball in another space", OwnershipPolicy{}, "stranger", "ball", "stranger", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := map[string]*Client{
+				"owner":     {id: "owner", space: "s", send: newSendQueue()},
+				"player":    {id: "player", space: "s", send: newSendQueue()},
+				"watcher":   {id: "watcher", space: "s", send: newSendQueue()},
+				"moderator": {id: "moderator", space: "s", authority: 1, send: newSendQueue()},
+				"stranger":  {id: "stranger", space: "t", authority: 2, send: newSendQueue()},
+			}
+			h := &Hub{
+				clients:      make(map[*Client]bool),
+				entityOwners: make(map[entityKey]*entityOwner),
+				moves:        make(map[entityKey]entityMove),
+				history:      newHistory(time.Second),
+				ownership:    tt.policy,
+			}
+			for _, c := range clients {
+				h.clients[c] = true
+			}
+			ball := entityKey{"s", "ball"}
+			h.entityOwners[ball] = &entityOwner{client: clients["owner"], updated: now.Add(-2 * time.Second)}
+			h.moves[ball] = entityMove{}
+			payload := `{"entity_id":"` + tt.entityID + `"}`
+			e := &server.Envelope{Payload: &server.Envelope_Rpc{Rpc: &server.TRpc{Id: rpcEntityRequest, Payload: payload}}}
+			sender := clients[tt.sender]
+			h.requestEntity(&MessageEnvelope{sender: sender, fromClient: sender.id, receivedAt: now}, e)
+			owner, ok := h.entityOwners[entityKey{sender.space, tt.entityID}]
+			if !ok {
+				t.Fatalf("%s has no owner", tt.entityID)
+			}
+			if owner.client.id != tt.wantOwner {
+				t.Errorf("owner %s, want %s", owner.client.id, tt.wantOwner)
+			}
+			// Each space has its own ball.
+			if sender.space != "s" && h.entityOwners[ball].client.id != "owner" {
+				t.Errorf("ball of s owned by %s, want owner", h.entityOwners[ball].client.id)
+			}
+			if _, kept := h.moves[ball]; kept == tt.wantReset {
+				t.Errorf("ball baseline kept = %v, want %v", kept, !tt.wantReset)
+			}
+			// The space hears of every change of owner.
+			changed := sender.space == "s" && (tt.wantOwner != "owner" || tt.entityID != "ball")
+			if told := clients["watcher"].send.len() > 0; told != changed {
+				t.Errorf("space told = %v, want %v", told, changed)
+			}
+			if clients["stranger"] != sender && clients["stranger"].send.len() > 0 {
+				t.Error("another space told of the change")
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"nakama/server"
+)
+
+const (
+	// Rpc id a client sends to change properties of its space.
+	rpcSpaceSet = "space_set"
+
+	// Rpc id of the properties sent to a client joining a space, and of the
+	// changes sent to its members.
+	rpcSpaceState = "space_state"
+
+	// Limits of the properties of a space.
+	maxSpaceProps     = 256
+	maxSpacePropValue = 1024
+)
+
+// spaceProp is a property of a space. Every change gives it a new version from
+// a counter of the hub, so a property deleted and set again never gets back
+// a version it had.
+type spaceProp struct {
+	Value   json.RawMessage `json:"value"`
+	Version int64           `json:"version"`
+}
+
+// propChange is a compare-and-set of a property: it applies if the property
+// is at Version, 0 for a property that does not exist. A null Value deletes
+// the property.
+type propChange struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value"`
+	Version int64           `json:"version"`
+}
+
+// spaceSet is the json payload of a space_set rpc and of its reply. The
+// changes apply together or not at all. The reply tells whether they were
+// accepted, and holds the current value and version of each key.
+type spaceSet struct {
+	Changes  []*propChange `json:"changes"`
+	Accepted bool          `json:"accepted"`
+}
+
+// spaceState is the json payload of a space_state rpc. Deleted properties
+// have a null value.
+type spaceState struct {
+	Props map[string]*spaceProp `json:"props"`
+}
+
+// setSpaceProps applies the compare-and-set changes of the sender to the
+// properties of its space. Accepted changes are sent to the members of the
+// space. Conflicting ones are rejected with the current versions. The reply
+// goes on the reliable lane, after the changes already sent to the sender.
+// Clients whose reliable lane is full are disconnected, as they would miss
+// changes.
+func (h *Hub) setSpaceProps(message *MessageEnvelope, e *server.Envelope) {
+	req := &spaceSet{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return
+	}
+	space := message.sender.space
+	props := h.spaceProps[space]
+	added := 0
+	keys := make(map[string]bool)
+	for _, c := range req.Changes {
+		if c.Key == "" || keys[c.Key] || len(c.Value) > maxSpacePropValue {
+			h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, fmt.Sprintf("bad property %q", c.Key)))
+			return
+		}
+		keys[c.Key] = true
+		if _, ok := props[c.Key]; !ok {
+			added++
+		}
+	}
+	if len(props)+added > maxSpaceProps {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "too many properties"))
+		return
+	}
+
+	req.Accepted = true
+	for _, c := range req.Changes {
+		var version int64
+		if p, ok := props[c.Key]; ok {
+			version = p.Version
+		}
+		if c.Version != version {
+			req.Accepted = false
+		}
+	}
+	if !req.Accepted {
+		for _, c := range req.Changes {
+			c.Value, c.Version = nil, 0
+			if p, ok := props[c.Key]; ok {
+				c.Value, c.Version = p.Value, p.Version
+			}
+		}
+		if !h.sendOn(message.sender, laneReliable, rpcEnvelope(rpcSpaceSet, e.CollationId, req)) {
+			h.remove(message.sender)
+		}
+		return
+	}
+
+	if props == nil {
+		props = make(map[string]*spaceProp)
+		h.spaceProps[space] = props
+	}
+	changed := &spaceState{Props: make(map[string]*spaceProp)}
+	for _, c := range req.Changes {
+		h.propVersion++
+		p := &spaceProp{Value: c.Value, Version: h.propVersion}
+		if isNull(c.Value) {
+			p.Value = nil
+			delete(props, c.Key)
+		} else {
+			props[c.Key] = p
+		}
+		changed.Props[c.Key] = p
+		c.Version = p.Version
+	}
+	if !h.sendOn(message.sender, laneReliable, rpcEnvelope(rpcSpaceSet, e.CollationId, req)) {
+		h.remove(message.sender)
+	}
+	state := rpcEnvelope(rpcSpaceState, "", changed)
+	for client := range h.clients {
+		if client.space == space && client != message.sender && !h.sendOn(client, laneReliable, state) {
+			h.remove(client)
+		}
+	}
+}
+
+// isNull reports whether a json value is missing or null.
+func isNull(v json.RawMessage) bool {
+	return len(v) == 0 || string(v) == "null"
+}
+
+// sendSpaceState sends a client joining a space the properties of the space.
+func (h *Hub) sendSpaceState(client *Client) {
+	if props := h.spaceProps[client.space]; len(props) > 0 {
+		h.sendOn(client, laneReliable, rpcEnvelope(rpcSpaceState, "", &spaceState{Props: props}))
+	}
+}
+
+// dropSpaceProps forgets the properties of the space of a client leaving it
+// if it was the last one in the space.
+func (h *Hub) dropSpaceProps(client *Client) {
+	for c := range h.clients {
+		if c != client && c.space == client.space {
+			return
+		}
+	}
+	delete(h.spaceProps, client.space)
+}
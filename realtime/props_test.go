@@ -0,0 +1,128 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"nakama/server"
+)
+
+// describeProps lists the properties of a space as key=value@version.
+func describeProps(props map[string]*spaceProp) string {
+	var list []string
+	for key, p := range props {
+		list = append(list, fmt.Sprintf("%s=%s@%d", key, p.Value, p.Version))
+	}
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
+
+func TestSetSpaceProps(t *testing.T) {
+	sender := &Client{id: "a", space: "s", send: newSendQueue()}
+	member := &Client{id: "b", space: "s", send: newSendQueue()}
+	h := &Hub{
+		clients:    map[*Client]bool{sender: true, member: true},
+		spaceProps: make(map[string]map[string]*spaceProp),
+	}
+	steps := []struct {
+		name    string
+		changes string
+		want    string
+	}{
+		{"new key", `[{"key":"score","value":1,"version":0}]`, "score=1@1"},
+		{"stale version", `[{"key":"score","value":2,"version":0}]`, "score=1@1"},
+		{"update", `[{"key":"score","value":2,"version":1}]`, "score=2@2"},
+		{"second key", `[{"key":"round","value":"one","version":0}]`, `round="one"@3 score=2@2`},
+		{"all or nothing", `[{"key":"score","value":3,"version":2},{"key":"round","value":"two","version":1}]`, `round="one"@3 score=2@2`},
+		{"delete", `[{"key":"round","value":null,"version":3}]`, "score=2@2"},
+		{"set again", `[{"key":"round","value":"three","version":0}]`, `round="three"@5 score=2@2`},
+		{"version before the delete", `[{"key":"round","value":"four","version":3}]`, `round="three"@5 score=2@2`},
+		{"duplicate key", `[{"key":"score","value":4,"version":2},{"key":"score","value":5,"version":2}]`, `round="three"@5 score=2@2`},
+		{"missing key", `[{"value":4,"version":0}]`, `round="three"@5 score=2@2`},
+	}
+	for _, step := range steps {
+		payload := `{"changes":` + step.changes + `}`
+		e := &server.Envelope{Payload: &server.Envelope_Rpc{Rpc: &server.TRpc{Id: rpcSpaceSet, Payload: payload}}}
+		h.setSpaceProps(&MessageEnvelope{sender: sender, fromClient: sender.id}, e)
+		if got := describeProps(h.spaceProps["s"]); got != step.want {
+			t.Errorf("%s: got %q, want %q", step.name, got, step.want)
+		}
+	}
+	// The member got the accepted changes only: the new key, the update,
+	// the second key, the delete and the key set again.
+	if n := member.send.len(); n != 5 {
+		t.Errorf("member got %d changes, want 5", n)
+	}
+}
+
+func TestSetSpacePropsLimit(t *testing.T) {
+	sender := &Client{id: "a", space: "s", send: newSendQueue()}
+	props := make(map[string]*spaceProp)
+	for i := 0; i < maxSpaceProps; i++ {
+		props[fmt.Sprint("k", i)] = &spaceProp{Value: []byte("1"), Version: 1}
+	}
+	h := &Hub{
+		clients:    map[*Client]bool{sender: true},
+		spaceProps: map[string]map[string]*spaceProp{"s": props},
+	}
+	tests := []struct {
+		name    string
+		changes string
+		want    bool
+	}{
+		{"new key over the limit", `[{"key":"extra","value":1,"version":0}]`, false},
+		{"existing key", `[{"key":"k0","value":2,"version":1}]`, true},
+		{"value too long", `[{"key":"k1","value":"` + strings.Repeat("x", maxSpacePropValue) + `","version":1}]`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := describeProps(props)
+			payload := `{"changes":` + tt.changes + `}`
+			e := &server.Envelope{Payload: &server.Envelope_Rpc{Rpc: &server.TRpc{Id: rpcSpaceSet, Payload: payload}}}
+			h.setSpaceProps(&MessageEnvelope{sender: sender, fromClient: sender.id}, e)
+			if changed := describeProps(props) != before; changed != tt.want {
+				t.Errorf("changed = %v, want %v", changed, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoveSpaceProps(t *testing.T) {
+	tests := []struct {
+		name string
+		// Whether another client stays in the old space.
+		stays bool
+	}{
+		{"last one out", false},
+		{"others stay", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{id: "a", space: "s", send: newSendQueue()}
+			h := &Hub{
+				clients:      map[*Client]bool{client: true},
+				entityOwners: make(map[entityKey]*entityOwner),
+				spaceProps: map[string]map[string]*spaceProp{
+					"s": {"k": {Value: []byte("1"), Version: 1}},
+					"t": {"k": {Value: []byte("2"), Version: 1}},
+				},
+			}
+			if tt.stays {
+				h.clients[&Client{id: "b", space: "s", send: newSendQueue()}] = true
+			}
+			h.moveSpace(client, "t")
+			if _, ok := h.spaceProps["s"]; ok != tt.stays {
+				t.Errorf("properties of the old space kept = %v, want %v", ok, tt.stays)
+			}
+			if n := client.send.len(); n != 1 {
+				t.Errorf("%d messages, want the space_state of the new space", n)
+			}
+		})
+	}
+}
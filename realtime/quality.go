@@ -0,0 +1,145 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Rpc id of the connection quality sent to the clients every
+	// Options.QualityInterval.
+	rpcConnectionQuality = "connection_quality"
+
+	// Longest time between two round trip time samples of a client.
+	qualityPingPeriod = 5 * time.Second
+)
+
+// Quality holds the connection statistics of a client.
+type Quality struct {
+	// Round trip time of the last ping, and its smoothed average.
+	RTT         time.Duration
+	SmoothedRTT time.Duration
+
+	// Mean deviation between consecutive round trip times.
+	Jitter time.Duration
+
+	// Number of pongs measured.
+	Samples int
+
+	// Number of messages waiting to be written to the client.
+	QueueDepth int
+}
+
+// connQuality accumulates the round trip times of a client. Pongs are
+// recorded from readPump, the hub reads the statistics.
+type connQuality struct {
+	mu      sync.Mutex
+	quality Quality
+}
+
+// record adds a round trip time, smoothed as in TCP and jitter as in RTP.
+func (q *connQuality) record(rtt time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.quality.Samples == 0 {
+		q.quality.SmoothedRTT = rtt
+	} else {
+		delta := rtt - q.quality.RTT
+		if delta < 0 {
+			delta = -delta
+		}
+		q.quality.Jitter += (delta - q.quality.Jitter) / 16
+		q.quality.SmoothedRTT += (rtt - q.quality.SmoothedRTT) / 8
+	}
+	q.quality.RTT = rtt
+	q.quality.Samples++
+}
+
+// Quality returns the connection statistics of the client. Clients without a
+// ping-capable transport only report their queue depth.
+func (c *Client) Quality() Quality {
+	c.quality.mu.Lock()
+	q := c.quality.quality
+	c.quality.mu.Unlock()
+	q.QueueDepth = c.send.len()
+	return q
+}
+
+// qualityReport is the json form of the quality of a client.
+type qualityReport struct {
+	ID          string  `json:"id"`
+	Space       string  `json:"space"`
+	RTT         float64 `json:"rtt_ms"`
+	SmoothedRTT float64 `json:"smoothed_rtt_ms"`
+	Jitter      float64 `json:"jitter_ms"`
+	Samples     int     `json:"samples"`
+	QueueDepth  int     `json:"queue_depth"`
+	Violations  int     `json:"violations"`
+}
+
+func newQualityReport(client *Client) *qualityReport {
+	q := client.Quality()
+	return &qualityReport{
+		ID:          client.id,
+		Space:       client.space,
+		RTT:         millis(q.RTT),
+		SmoothedRTT: millis(q.SmoothedRTT),
+		Jitter:      millis(q.Jitter),
+		Samples:     q.Samples,
+		QueueDepth:  q.QueueDepth,
+		Violations:  client.violations,
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// pingPeriod returns the time between two pings of a client, short enough
+// for every connection_quality rpc to carry a new sample.
+func (h *Hub) pingPeriod() time.Duration {
+	if h.qualityInterval > 0 && h.qualityInterval < qualityPingPeriod {
+		return h.qualityInterval
+	}
+	return qualityPingPeriod
+}
+
+// sendQuality sends every connected client its connection quality.
+func (h *Hub) sendQuality() {
+	for client := range h.clients {
+		if client.transport != nil {
+			h.send(client, rpcEnvelope(rpcConnectionQuality, "", newQualityReport(client)))
+		}
+	}
+}
+
+// serveClients writes the connection quality of the connected clients as
+// json, sorted by id.
+func (s *Server) serveClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var reports []*qualityReport
+	ok := s.hub.call(func() {
+		for client := range s.hub.clients {
+			if client.transport != nil {
+				reports = append(reports, newQualityReport(client))
+			}
+		}
+	})
+	if !ok {
+		http.Error(w, "Server shutting down", 503)
+		return
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ID < reports[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
@@ -0,0 +1,208 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"bytes"
+	"sync"
+
+	"nakama/server"
+)
+
+// Lanes of a send queue, highest priority first.
+const (
+	// Notices, errors and rpc replies from the server.
+	laneControl = iota
+
+	// Messages relayed between clients, and server messages that must
+	// arrive in order.
+	laneReliable
+
+	// Entity state. Only the newest message per entity is kept.
+	laneState
+
+	numLanes
+)
+
+// Maximum number of messages waiting in a lane.
+const laneSize = 256
+
+// sendQueue holds the outbound messages of a client in priority lanes. The
+// hub pushes and writePump takes the messages, control first, then reliable,
+// then state.
+type sendQueue struct {
+	mu sync.Mutex
+
+	// Messages of the control and reliable lanes.
+	lanes [laneState][][]byte
+
+	// Messages of the state lane by entity, and the entities in arrival
+	// order.
+	state     map[entityKey]*stateMessage
+	stateKeys []entityKey
+
+	closed bool
+
+	// Signalled when messages are pushed or the queue is closed.
+	ready chan struct{}
+}
+
+// stateMessage is a message of the state lane and the server_tick rpc
+// stamping it, nil if it carries its own time.
+type stateMessage struct {
+	stamp []byte
+	data  []byte
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{state: make(map[entityKey]*stateMessage), ready: make(chan struct{}, 1)}
+}
+
+// push adds a message to the control or reliable lane. It reports false if
+// the lane is full or the queue closed.
+func (q *sendQueue) push(lane int, data []byte) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || len(q.lanes[lane]) >= laneSize {
+		return false
+	}
+	q.lanes[lane] = append(q.lanes[lane], data)
+	q.signal()
+	return true
+}
+
+// pushState adds a message, stamped by stamp, to the state lane. It replaces
+// the waiting message of the same entity, and drops the oldest one if the lane
+// is full.
+func (q *sendQueue) pushState(key entityKey, stamp, data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	if _, ok := q.state[key]; !ok {
+		if len(q.stateKeys) >= laneSize {
+			delete(q.state, q.stateKeys[0])
+			q.stateKeys = q.stateKeys[1:]
+		}
+		q.stateKeys = append(q.stateKeys, key)
+	}
+	q.state[key] = &stateMessage{stamp: stamp, data: data}
+	q.signal()
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take removes the waiting messages in priority order. Each state message
+// follows its stamp, sent once for consecutive messages sharing it. It
+// reports false once the queue is closed, the messages returned are then the
+// last ones.
+func (q *sendQueue) take() ([][]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var messages [][]byte
+	for lane := range q.lanes {
+		messages = append(messages, q.lanes[lane]...)
+		q.lanes[lane] = nil
+	}
+	var stamp []byte
+	for _, key := range q.stateKeys {
+		m := q.state[key]
+		if m.stamp != nil && !bytes.Equal(m.stamp, stamp) {
+			messages = append(messages, m.stamp)
+			stamp = m.stamp
+		}
+		messages = append(messages, m.data)
+		delete(q.state, key)
+	}
+	q.stateKeys = nil
+	return messages, !q.closed
+}
+
+// len returns the number of waiting messages.
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.stateKeys)
+	for lane := range q.lanes {
+		n += len(q.lanes[lane])
+	}
+	return n
+}
+
+// close stops the queue. The waiting messages can still be taken.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+// dropState removes the waiting update of an entity.
+func (q *sendQueue) dropState(key entityKey) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.state[key]; !ok {
+		return
+	}
+	delete(q.state, key)
+	for i, k := range q.stateKeys {
+		if k == key {
+			q.stateKeys = append(q.stateKeys[:i], q.stateKeys[i+1:]...)
+			break
+		}
+	}
+}
+
+// closeWith adds a last message to the control or reliable lane, even if the
+// lane is full, and stops the queue.
+func (q *sendQueue) closeWith(lane int, data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.lanes[lane] = append(q.lanes[lane], data)
+	}
+	q.closed = true
+	q.signal()
+}
+
+// statePart is the update of one entity of a SpacePresence message, and the
+// server_tick rpc stamping it. The state lane and the level of detail work
+// per entity, so an update of some entities never replaces or holds back the
+// update of others.
+type statePart struct {
+	entity entityKey
+	sp     *server.SpacePresence
+	frame  *frame
+	tick   *serverTick
+	stamp  *frame
+}
+
+// stateParts splits a SpacePresence message into one part per entity. The
+// update of a single entity keeps the data of the message. The parts share
+// the stamp of the message.
+func stateParts(message *MessageEnvelope) []*statePart {
+	sp := message.envelope.GetSpacePresence()
+	stamp := &frame{}
+	stamp.data, _ = marshal(rpcEnvelope(rpcServerTick, "", message.tick))
+	if len(sp.Changes) == 1 {
+		return []*statePart{{entity: entityKey{message.sender.space, sp.Changes[0].Id}, sp: sp, frame: &frame{data: message.data}, tick: message.tick, stamp: stamp}}
+	}
+	parts := make([]*statePart, 0, len(sp.Changes))
+	for _, entity := range sp.Changes {
+		one := &server.SpacePresence{Changes: []*server.Entity{entity}}
+		data, err := marshal(&server.Envelope{Payload: &server.Envelope_SpacePresence{SpacePresence: one}})
+		if err != nil {
+			continue
+		}
+		parts = append(parts, &statePart{entity: entityKey{message.sender.space, entity.Id}, sp: one, frame: &frame{data: data}, tick: message.tick, stamp: stamp})
+	}
+	return parts
+}
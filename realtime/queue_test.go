@@ -0,0 +1,152 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"nakama/server"
+)
+
+func TestPushState(t *testing.T) {
+	type push struct{ key, data string }
+	full := make([]push, 0, laneSize+1)
+	want := make([]string, 0, laneSize)
+	for i := 0; i <= laneSize; i++ {
+		key := fmt.Sprint("e", i)
+		full = append(full, push{key, key})
+		if i > 0 {
+			want = append(want, key)
+		}
+	}
+	tests := []struct {
+		name   string
+		pushes []push
+		want   []string
+	}{
+		{"one entity", []push{{"a", "a1"}}, []string{"a1"}},
+		{"newest update of an entity", []push{{"a", "a1"}, {"a", "a2"}}, []string{"a2"}},
+		{"entities kept apart", []push{{"a", "a1"}, {"b", "b1"}, {"a", "a2"}}, []string{"a2", "b1"}},
+		{"oldest dropped when full", full, want},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newSendQueue()
+			for _, p := range tt.pushes {
+				q.pushState(entityKey{"s", p.key}, nil, []byte(p.data))
+			}
+			messages, ok := q.take()
+			if !ok {
+				t.Fatal("queue closed")
+			}
+			got := make([]string, 0, len(messages))
+			for _, m := range messages {
+				got = append(got, string(m))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushStateSpaces(t *testing.T) {
+	q := newSendQueue()
+	q.pushState(entityKey{"s", "ball"}, nil, []byte("s1"))
+	q.pushState(entityKey{"t", "ball"}, nil, []byte("t1"))
+	q.dropState(entityKey{"s", "ball"})
+	messages, _ := q.take()
+	if len(messages) != 1 || string(messages[0]) != "t1" {
+		t.Errorf("got %q, want the ball of t only", messages)
+	}
+}
+
+func TestPushStateAfterClose(t *testing.T) {
+	q := newSendQueue()
+	q.close()
+	q.pushState(entityKey{"s", "a"}, nil, []byte("a1"))
+	if n := q.len(); n != 0 {
+		t.Errorf("len = %d, want 0", n)
+	}
+}
+
+func TestPushStateStamps(t *testing.T) {
+	type push struct{ key, stamp, data string }
+	tests := []struct {
+		name   string
+		pushes []push
+		want   []string
+	}{
+		{"stamp first", []push{{"a", "t1", "a1"}}, []string{"t1", "a1"}},
+		{"shared stamp sent once", []push{{"a", "t1", "a1"}, {"b", "t1", "b1"}}, []string{"t1", "a1", "b1"}},
+		{"new stamp", []push{{"a", "t1", "a1"}, {"b", "t2", "b2"}}, []string{"t1", "a1", "t2", "b2"}},
+		{"replaced update keeps its place", []push{{"a", "t1", "a1"}, {"b", "t1", "b1"}, {"a", "t2", "a2"}}, []string{"t2", "a2", "t1", "b1"}},
+		{"no stamp", []push{{"a", "t1", "a1"}, {"d", "", "d1"}, {"b", "t1", "b1"}}, []string{"t1", "a1", "d1", "b1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newSendQueue()
+			for _, p := range tt.pushes {
+				var stamp []byte
+				if p.stamp != "" {
+					stamp = []byte(p.stamp)
+				}
+				q.pushState(entityKey{"s", p.key}, stamp, []byte(p.data))
+			}
+			messages, _ := q.take()
+			got := make([]string, 0, len(messages))
+			for _, m := range messages {
+				got = append(got, string(m))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateParts(t *testing.T) {
+	entity := func(id string) *server.Entity {
+		return &server.Entity{Id: id, UserId: "u", Position: &server.V3{X: 1}}
+	}
+	tests := []struct {
+		name    string
+		changes []*server.Entity
+		want    []string
+	}{
+		{"one entity", []*server.Entity{entity("a")}, []string{"a"}},
+		{"several entities", []*server.Entity{entity("a"), entity("b"), entity("c")}, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := &server.SpacePresence{Changes: tt.changes}
+			e := &server.Envelope{Payload: &server.Envelope_SpacePresence{SpacePresence: sp}}
+			tick := &serverTick{ServerTime: 7, Tick: 3}
+			message := &MessageEnvelope{sender: &Client{space: "s"}, envelope: e, data: []byte("message"), tick: tick}
+			parts := stateParts(message)
+			var got []string
+			for _, part := range parts {
+				got = append(got, part.entity.id)
+				if part.entity.space != "s" {
+					t.Errorf("part %s in space %q, want the space of the sender", part.entity.id, part.entity.space)
+				}
+				if len(part.sp.Changes) != 1 || part.sp.Changes[0].Id != part.entity.id {
+					t.Errorf("part %s holds %v", part.entity.id, part.sp.Changes)
+				}
+				if part.tick != tick || part.stamp != parts[0].stamp {
+					t.Errorf("part %s stamped %v, want %v shared by the parts", part.entity.id, part.tick, tick)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if len(tt.changes) == 1 && string(parts[0].frame.data) != "message" {
+				t.Errorf("single entity data %q, want the message data", parts[0].frame.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+
+	"nakama/server"
+)
+
+// Roles of a client, from the role query parameter of its session.
+const (
+	// Plays in the space. The default role.
+	RolePlayer = "player"
+
+	// Only receives. Its envelopes are not relayed and it is not listed in
+	// the presences of the space.
+	RoleSpectator = "spectator"
+
+	// Plays, and can kick and mute the clients of its space. The session
+	// needs the key query parameter set to Options.ModeratorKey.
+	RoleModerator = "moderator"
+)
+
+const (
+	// Rpc ids a moderator sends to act on a client of its space.
+	rpcModerateKick   = "moderate_kick"
+	rpcModerateMute   = "moderate_mute"
+	rpcModerateUnmute = "moderate_unmute"
+
+	// Rpc id of the notice sent to a kicked client.
+	rpcKicked = "kicked"
+
+	// How long a kicked user may not come back to the space, unless the
+	// kick sets a duration.
+	defaultKickBan = 5 * time.Minute
+)
+
+// Server rpcs that would make a spectator take part in the game.
+var playerRPCs = map[string]bool{
+	rpcMatchmakerAdd: true,
+	rpcMatchCreate:   true,
+	rpcMatchJoin:     true,
+	rpcSpaceSet:      true,
+	rpcEntityRequest: true,
+}
+
+// moderation is the json payload of the moderate rpcs and of the kicked
+// notice. A mute lasts DurationMs, or until unmuted if zero. A kicked user
+// may not come back to the space for DurationMs, or defaultKickBan if zero.
+type moderation struct {
+	UserID     string `json:"user_id"`
+	Reason     string `json:"reason,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+}
+
+// sanctionKey identifies a user in a space.
+type sanctionKey struct {
+	userID string
+	space  string
+}
+
+// sanction holds the kick and mute of a user in a space. They are kept by
+// the hub rather than on the client, so reconnecting does not lift them.
+type sanction struct {
+	// Time the user may come back after a kick.
+	bannedUntil time.Time
+
+	// Whether the user is muted, and until when, zero for good.
+	muted      bool
+	mutedUntil time.Time
+}
+
+var (
+	errModeratorKey = errors.New("moderator role needs a valid key")
+	errKicked       = errors.New("kicked")
+)
+
+// sessionRole returns the role requested by the session, checking the key of
+// moderators.
+func (h *Hub) sessionRole(r *http.Request) (string, error) {
+	query := r.URL.Query()
+	switch role := query.Get("role"); role {
+	case "", RolePlayer:
+		return RolePlayer, nil
+	case RoleSpectator:
+		return role, nil
+	case RoleModerator:
+		key := query.Get("key")
+		if h.moderatorKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(h.moderatorKey)) != 1 {
+			return "", errModeratorKey
+		}
+		return role, nil
+	default:
+		return "", errors.New("unknown role " + role)
+	}
+}
+
+// Role returns the role of the client.
+func (c *Client) Role() string {
+	return c.role
+}
+
+// isRPC reports whether data is an envelope holding an rpc.
+func isRPC(data []byte) bool {
+	e := &server.Envelope{}
+	return proto.Unmarshal(data, e) == nil && e.GetRpc() != nil
+}
+
+// banned reports whether the client was kicked from its space and may not
+// come back yet at time now.
+func (h *Hub) banned(client *Client, now time.Time) bool {
+	s, ok := h.sanctions[sanctionKey{client.id, client.space}]
+	return ok && now.Before(s.bannedUntil)
+}
+
+// muted reports whether the client may not talk in its space at time now.
+func (h *Hub) muted(client *Client, now time.Time) bool {
+	s, ok := h.sanctions[sanctionKey{client.id, client.space}]
+	return ok && s.muted && (s.mutedUntil.IsZero() || now.Before(s.mutedUntil))
+}
+
+// sanction returns the sanction of the user in the space, creating it. The
+// sanctions over are dropped.
+func (h *Hub) sanction(userID, space string, now time.Time) *sanction {
+	for key, s := range h.sanctions {
+		if !now.Before(s.bannedUntil) && (!s.muted || (!s.mutedUntil.IsZero() && !now.Before(s.mutedUntil))) {
+			delete(h.sanctions, key)
+		}
+	}
+	key := sanctionKey{userID, space}
+	s, ok := h.sanctions[key]
+	if !ok {
+		s = &sanction{}
+		h.sanctions[key] = s
+	}
+	return s
+}
+
+// mayCall reports whether the sender may call the rpc in e, and tells it why
+// not. Spectators may not call the rpcs that make them play, muted clients
+// may not chat.
+func (h *Hub) mayCall(message *MessageEnvelope, e *server.Envelope) bool {
+	id := e.GetRpc().Id
+	switch {
+	case message.sender.role == RoleSpectator && playerRPCs[id]:
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "spectators are receive-only"))
+		return false
+	case id == rpcChatSend && h.muted(message.sender, message.receivedAt):
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "muted"))
+		return false
+	}
+	return true
+}
+
+// mayRelay reports whether the sender may relay e to its space or match, and
+// tells it why not. e is nil for messages that are not envelopes. Spectators
+// relay nothing, muted clients only their entity updates.
+func (h *Hub) mayRelay(message *MessageEnvelope, e *server.Envelope) bool {
+	var collationID string
+	if e != nil {
+		collationID = e.CollationId
+	}
+	switch {
+	case message.sender.role == RoleSpectator:
+		h.send(message.sender, errorEnvelope(collationID, errCodeRejected, "spectators are receive-only"))
+		return false
+	case h.muted(message.sender, message.receivedAt) && (e == nil || e.GetSpacePresence() == nil):
+		h.send(message.sender, errorEnvelope(collationID, errCodeRejected, "muted"))
+		return false
+	}
+	return true
+}
+
+// moderate handles the kick, mute and unmute rpcs of moderators. Their target
+// has to be in the space of the moderator. The sanction applies to the user
+// id in the space, so it holds when the user reconnects.
+func (h *Hub) moderate(message *MessageEnvelope, e *server.Envelope) {
+	if message.sender.role != RoleModerator {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "not a moderator"))
+		return
+	}
+	req := &moderation{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return
+	}
+	var targets []*Client
+	for client := range h.clients {
+		if client.id == req.UserID && client.space == message.sender.space {
+			targets = append(targets, client)
+		}
+	}
+	if len(targets) == 0 {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, "no client "+req.UserID+" in space"))
+		return
+	}
+	now := message.receivedAt
+	duration := time.Duration(req.DurationMs) * time.Millisecond
+	s := h.sanction(req.UserID, message.sender.space, now)
+	switch e.GetRpc().Id {
+	case rpcModerateKick:
+		if duration <= 0 {
+			duration = defaultKickBan
+		}
+		s.bannedUntil = now.Add(duration)
+		for _, client := range targets {
+			h.sendOn(client, laneControl, rpcEnvelope(rpcKicked, "", &moderation{UserID: message.sender.id, Reason: req.Reason, DurationMs: req.DurationMs}))
+			client.closeCode = websocket.ClosePolicyViolation
+			client.closeReason = "kicked"
+			h.remove(client)
+		}
+	case rpcModerateMute:
+		s.muted, s.mutedUntil = true, time.Time{}
+		if duration > 0 {
+			s.mutedUntil = now.Add(duration)
+		}
+	case rpcModerateUnmute:
+		s.muted = false
+	}
+	h.send(message.sender, rpcEnvelope(e.GetRpc().Id, e.CollationId, req))
+}
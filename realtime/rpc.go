@@ -0,0 +1,77 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"nakama/server"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// rpcFunc handles an rpc addressed to the server. e is the envelope carrying
+// the rpc, message the inbound message it was read from.
+type rpcFunc func(message *MessageEnvelope, e *server.Envelope)
+
+// rpcEnvelope builds an rpc envelope with v as json payload.
+func rpcEnvelope(id, collationID string, v interface{}) *server.Envelope {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("marshal error: ", err)
+	}
+	return &server.Envelope{
+		CollationId: collationID,
+		Payload:     &server.Envelope_Rpc{Rpc: &server.TRpc{Id: id, Payload: string(payload)}},
+	}
+}
+
+func errorEnvelope(collationID string, code int32, message string) *server.Envelope {
+	return &server.Envelope{
+		CollationId: collationID,
+		Payload:     &server.Envelope_Error{Error: &server.Error{Code: code, Message: message}},
+	}
+}
+
+func marshal(e *server.Envelope) ([]byte, error) {
+	data, err := proto.Marshal(e)
+	if err != nil {
+		fmt.Println("marshal error: ", err)
+	}
+	return data, err
+}
+
+// send queues e for the client on the control lane, ahead of the messages
+// relayed from other clients.
+func (h *Hub) send(client *Client, e *server.Envelope) {
+	h.sendOn(client, laneControl, e)
+}
+
+// sendOn queues e for the client in its encoding on the control or reliable
+// lane. It reports false if the client misses the message because the lane
+// is full or the queue closed.
+func (h *Hub) sendOn(client *Client, lane int, e *server.Envelope) bool {
+	data, ok := encodeFor(client, e)
+	return ok && client.send.push(lane, data)
+}
+
+// encodeFor marshals e in the encoding of the client.
+func encodeFor(client *Client, e *server.Envelope) ([]byte, bool) {
+	var data []byte
+	var err error
+	if client.encoding == subprotocolJSON {
+		var s string
+		s, err = jsonMarshaler.MarshalToString(e)
+		data = []byte(s)
+	} else {
+		data, err = proto.Marshal(e)
+	}
+	if err != nil {
+		fmt.Println("marshal error: ", err)
+		return nil, false
+	}
+	return data, true
+}
@@ -0,0 +1,323 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package realtime relays nakama envelopes between the clients of a space
+// over websockets, with server-side matchmaking, chat, matches, hooks and Lua
+// modules on top.
+package realtime
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Options holds the settings of a Server.
+type Options struct {
+	// TCP address Start serves the Handler on. Empty means the Handler is
+	// only mounted by the caller.
+	Addr string
+
+	// Listener Start serves the Handler on instead of listening on Addr,
+	// such as a socket inherited from the process being replaced.
+	Listener net.Listener
+
+	// How far back entity positions are kept for lag compensation. It must
+	// not be negative.
+	HistoryWindow time.Duration
+
+	// How long a matchmaker ticket waits for a match before it expires.
+	// Zero or less means tickets never expire.
+	TicketTimeout time.Duration
+
+	// Path of the chat database file. Empty means no chat: the chat rpcs
+	// are refused.
+	ChatDB string
+
+	// Number of messages sent to a client joining a chat channel.
+	ChatJoinHistory int
+
+	// Custom server logic. Nil means no hooks.
+	Hooks Hooks
+
+	// Directory of the Lua modules to load. Empty means no Lua runtime.
+	LuaDir string
+
+	// Constructors of the authoritative match handlers, by name.
+	MatchHandlers map[string]func() MatchHandler
+
+	// Server-simulated bots.
+	Bots BotConfig
+
+	// Address of the udp channel for SpacePresence updates. Empty means no
+	// udp channel.
+	UDPAddr string
+
+	// Delta updates: positions are sent in multiples of DeltaQuantum, as is
+	// if zero, and each entity is sent in full every DeltaKeyframe, only on
+	// join and resync if zero.
+	DeltaQuantum  float32
+	DeltaKeyframe time.Duration
+
+	// Movement rules by space. The rules under AnySpace apply to the spaces
+	// not listed. Nil means entities move freely.
+	Movement map[string]*MovementRules
+
+	// Decides who gets the entities requested by clients.
+	Ownership OwnershipPolicy
+
+	// Key a session needs to have the moderator role. Empty means no client
+	// can be a moderator.
+	ModeratorKey string
+
+	// Teams the players of each space are spread over as they join. Hooks
+	// may set the team of a client with Client.SetTeam instead.
+	Teams []string
+
+	// Hides entities from the other teams. Nil means teams see each other.
+	FogOfWar *FogOfWar
+
+	// Trigger zones by space. The zones under AnySpace apply to the spaces
+	// not listed.
+	Zones map[string][]Zone
+
+	// Update rates of the SpacePresence sent to a client by distance from
+	// its entity, sorted by distance. Nil sends every update.
+	LODBands []LODBand
+
+	// Period of the connection_quality rpcs sent to the clients. Zero means
+	// they are not sent.
+	QualityInterval time.Duration
+
+	// Time given to Shutdown once the context passed to Start is done.
+	// Zero means defaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+}
+
+const (
+	// Rpc id of the notice sent to every client when the server shuts down.
+	rpcServerShutdown = "server_shutdown"
+
+	shutdownReason = "server shutting down"
+
+	// Time given to Shutdown when Options.ShutdownTimeout is zero.
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+var errStarted = errors.New("server already started or shut down")
+
+// serverShutdown is the json payload of a server_shutdown rpc.
+type serverShutdown struct {
+	Reason string `json:"reason"`
+}
+
+// Server runs a hub and serves its websocket and server-sent events
+// endpoints.
+type Server struct {
+	opts     Options
+	hub      *Hub
+	upgrader websocket.Upgrader
+	sse      *sseSessions
+	mux      *http.ServeMux
+
+	httpServer *http.Server
+	listener   net.Listener
+
+	// Closed once the hub goroutine returned.
+	hubDone chan struct{}
+
+	// Set to 1 once Start or Shutdown is called. The hub then runs, or
+	// never will.
+	started int32
+
+	// Set to 1 once Shutdown is called, new connections are then refused.
+	shuttingDown int32
+
+	// Set to 1 once Detach is called.
+	detached int32
+}
+
+// NewServer creates a server from the options. Nothing runs until Start is
+// called.
+func NewServer(opts *Options) (*Server, error) {
+	hub, err := newHub(opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		opts: *opts,
+		hub:  hub,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			Subprotocols:    []string{subprotocolProtobuf, subprotocolJSON},
+		},
+		mux:     http.NewServeMux(),
+		hubDone: make(chan struct{}),
+	}
+	s.sse = newSSESessions(s.draining)
+	s.mux.HandleFunc("/ws", s.serveWs)
+	s.mux.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) {
+		s.sse.serve(hub, w, r)
+	})
+	return s, nil
+}
+
+// Hub returns the hub of the server.
+func (s *Server) Hub() *Hub {
+	return s.hub
+}
+
+// Handler returns the handler of the /ws and /sse endpoints, and of the
+// patterns added with Handle.
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// AdminHandler returns the handler of the admin endpoints, to be served apart
+// from the public ones. GET /admin/clients lists the connection quality of the
+// connected clients.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/clients", s.serveClients)
+	return mux
+}
+
+// Handle adds a handler to the ones served by Handler.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start runs the hub and, if Options.Listener or Options.Addr is set, serves
+// the Handler on it. It returns once the server listens. The server runs
+// until ctx is done or Shutdown is called. A server starts at most once, and
+// not after Shutdown.
+func (s *Server) Start(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		return errStarted
+	}
+	ln := s.opts.Listener
+	if ln == nil && s.opts.Addr != "" {
+		var err error
+		ln, err = net.Listen("tcp", s.opts.Addr)
+		if err != nil {
+			atomic.StoreInt32(&s.started, 0)
+			return err
+		}
+	}
+	if ln != nil {
+		s.listener = ln
+		s.httpServer = &http.Server{Handler: s.mux}
+		go func() {
+			err := s.httpServer.Serve(ln)
+			if err != nil && err != http.ErrServerClosed && atomic.LoadInt32(&s.detached) == 0 {
+				log.Println("Serve: ", err)
+			}
+		}()
+	}
+	go func() {
+		s.hub.run()
+		close(s.hubDone)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			timeout := s.opts.ShutdownTimeout
+			if timeout == 0 {
+				timeout = defaultShutdownTimeout
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			s.Shutdown(ctx)
+		case <-s.hubDone:
+		}
+	}()
+	return nil
+}
+
+// ListenerFile returns a duplicate of the listening socket, to be passed to
+// the process taking over. The caller closes it.
+func (s *Server) ListenerFile() (*os.File, error) {
+	ln, ok := s.listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, errors.New("listener has no file")
+	}
+	return ln.File()
+}
+
+// Detach hands the server over to another process, once that process
+// started. It stops accepting connections and closes the chat database and
+// the udp socket so the other process can open them. The connected clients
+// are served until Shutdown.
+func (s *Server) Detach() error {
+	atomic.StoreInt32(&s.detached, 1)
+	s.hub.call(s.hub.release)
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// Clients returns the number of connected clients, bots excluded.
+func (s *Server) Clients() int {
+	n := 0
+	s.hub.call(func() {
+		for client := range s.hub.clients {
+			if client.transport != nil {
+				n++
+			}
+		}
+	})
+	return n
+}
+
+func (s *Server) draining() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
+
+// Shutdown refuses new connections and stops the hub. The clients get a
+// server_shutdown rpc after their pending messages, then a going away close
+// frame. Shutdown waits for the send queues to be flushed, then stops
+// serving. It returns ctx.Err() if ctx is done first. Called before Start, it
+// only releases what NewServer opened.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	if atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		s.hub.stop()
+		s.hub.close()
+		close(s.hubDone)
+		return nil
+	}
+	s.hub.stop()
+	select {
+	case <-s.hubDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		s.hub.pumps.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if s.httpServer != nil {
+		return s.httpServer.Shutdown(ctx)
+	}
+	return nil
+}
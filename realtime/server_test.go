@@ -0,0 +1,45 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestServerLifecycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		start bool
+	}{
+		{"started", true},
+		{"never started", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewServer(&Options{})
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+			if tt.start {
+				if err := s.Start(context.Background()); err != nil {
+					t.Fatalf("Start: %v", err)
+				}
+				if err := s.Start(context.Background()); err != errStarted {
+					t.Errorf("second Start = %v, want %v", err, errStarted)
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := s.Shutdown(ctx); err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+			if err := s.Start(context.Background()); err != errStarted {
+				t.Errorf("Start after Shutdown = %v, want %v", err, errStarted)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+var errTransportClosed = errors.New("transport closed")
+
+// sseTransport is a Transport for peers that cannot open a websocket. The
+// outbound messages are streamed as server-sent events over a GET request.
+// The inbound messages are POSTed one per request with the session id; an
+// empty POST only tells the server the peer is still there.
+type sseTransport struct {
+	w  io.Writer
+	rc *http.ResponseController
+
+	// Time allowed to write a message to the peer.
+	writeWait time.Duration
+
+	inbound   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func (t *sseTransport) Read() ([]byte, error) {
+	timeout := time.NewTimer(pongWait)
+	defer timeout.Stop()
+	for {
+		select {
+		case message := <-t.inbound:
+			if len(message) > 0 {
+				return message, nil
+			}
+			timeout.Reset(pongWait)
+		case <-timeout.C:
+			return nil, errors.New("sse: peer timed out")
+		case <-t.closed:
+			return nil, errTransportClosed
+		}
+	}
+}
+
+// Write sends each message as one event. Messages spanning several lines are
+// sent as several data fields, which the peer joins back with newlines.
+func (t *sseTransport) Write(messages [][]byte) error {
+	var buf bytes.Buffer
+	for _, message := range messages {
+		for _, line := range bytes.Split(message, newline) {
+			buf.WriteString("data: ")
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		buf.WriteByte('\n')
+	}
+	return t.flush(buf.Bytes())
+}
+
+// WriteClose sends an event named close with the code and reason as data.
+func (t *sseTransport) WriteClose(code int, reason string) error {
+	if code == 0 {
+		return t.flush([]byte("event: close\ndata:\n\n"))
+	}
+	return t.flush([]byte(fmt.Sprintf("event: close\ndata: %d %s\n\n", code, reason)))
+}
+
+func (t *sseTransport) Ping() error {
+	return t.flush([]byte(": ping\n\n"))
+}
+
+// flush writes data and flushes it to the peer. Like the websocket writes, it
+// fails once writeWait elapsed, so a peer that stops reading cannot block
+// writePump.
+func (t *sseTransport) flush(data []byte) error {
+	if err := t.rc.SetWriteDeadline(time.Now().Add(t.writeWait)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := t.w.Write(data); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+func (t *sseTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.onClose()
+	})
+	return nil
+}
+
+// sseSessions holds the open server-sent events sessions by id.
+type sseSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*sseTransport
+
+	// Reports whether new sessions are refused.
+	draining func() bool
+}
+
+func newSSESessions(draining func() bool) *sseSessions {
+	return &sseSessions{sessions: make(map[string]*sseTransport), draining: draining}
+}
+
+// serve handles the server-sent events requests from the peer. A GET opens a
+// session: its first event, named session, carries the session id, and the
+// envelopes follow as json. A POST with the session query parameter sends a
+// message on the session.
+func (s *sseSessions) serve(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if s.draining() {
+			http.Error(w, "Server shutting down", 503)
+			return
+		}
+		role, err := hub.sessionRole(r)
+		if err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		s.serveEvents(hub, role, w, r)
+	case "POST":
+		s.servePost(w, r)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+func (s *sseSessions) serveEvents(hub *Hub, role string, w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming unsupported", 500)
+		return
+	}
+	id := uuid.NewV4().String()
+	t := &sseTransport{
+		w:         w,
+		rc:        http.NewResponseController(w),
+		writeWait: writeWait,
+		inbound:   make(chan []byte, 256),
+		closed:    make(chan struct{}),
+	}
+	t.onClose = func() {
+		s.mu.Lock()
+		delete(s.sessions, id)
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.sessions[id] = t
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := t.flush([]byte(fmt.Sprintf("event: session\ndata: %s\n\n", id))); err != nil {
+		t.Close()
+		return
+	}
+
+	// Only json can be sent as text events.
+	client := newClient(hub, t, subprotocolJSON, role, r)
+	if !client.hub.registerClient(client) {
+		t.Close()
+		return
+	}
+	go client.readPump()
+	go func() {
+		select {
+		case <-r.Context().Done():
+			t.Close()
+		case <-t.closed:
+		}
+	}()
+	// The response can only be written while the handler runs.
+	client.writePump()
+}
+
+func (s *sseSessions) servePost(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	t, ok := s.sessions[r.URL.Query().Get("session")]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	message, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+	if err != nil {
+		http.Error(w, "Bad request", 400)
+		return
+	}
+	if len(message) > maxMessageSize {
+		http.Error(w, "Request entity too large", 413)
+		return
+	}
+	select {
+	case t.inbound <- message:
+		w.WriteHeader(204)
+	case <-t.closed:
+		http.Error(w, "Not found", 404)
+	}
+}
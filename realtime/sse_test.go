@@ -0,0 +1,50 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSSEWriteDeadline(t *testing.T) {
+	failed := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr := &sseTransport{
+			w:         w,
+			rc:        http.NewResponseController(w),
+			writeWait: 100 * time.Millisecond,
+			closed:    make(chan struct{}),
+		}
+		message := bytes.Repeat([]byte("x"), 64<<10)
+		for {
+			if err := tr.Write([][]byte{message}); err != nil {
+				failed <- err
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	// A peer that opens the stream and never reads it.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", srv.Listener.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to a peer that does not read never failed")
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"strings"
+	"time"
+
+	"nakama/server"
+)
+
+const (
+	// Prefix of the rpc ids relayed only to the team of the sender.
+	teamRPCPrefix = "team:"
+
+	// Rpc id of the notice telling a client its team.
+	rpcTeamAssigned = "team_assigned"
+
+	// Rpc id of the notice telling a client an entity of another team went
+	// under the fog of war.
+	rpcEntityHidden = "entity_hidden"
+)
+
+// teamAssigned is the json payload of a team_assigned rpc.
+type teamAssigned struct {
+	Team string `json:"team"`
+}
+
+// entityHidden is the json payload of an entity_hidden rpc.
+type entityHidden struct {
+	EntityID string `json:"entity_id"`
+}
+
+// FogOfWar hides the entities of a team from the other teams.
+type FogOfWar struct {
+	// Entities are seen by the other teams within Range of one of their
+	// members, never if zero.
+	Range float32
+}
+
+// Team returns the team of the client, empty if it has none.
+func (c *Client) Team() string {
+	return c.team
+}
+
+// SetTeam moves the client to a team, empty for none. It must be called from
+// the hub goroutine, such as in a hook.
+func (c *Client) SetTeam(team string) {
+	c.team = team
+}
+
+// assignTeam puts a player joining its space in the team with the fewest
+// players.
+func (h *Hub) assignTeam(client *Client) {
+	if len(h.teams) == 0 || client.role == RoleSpectator {
+		return
+	}
+	counts := make(map[string]int)
+	for c := range h.clients {
+		if c.space == client.space && c.team != "" {
+			counts[c.team]++
+		}
+	}
+	client.team = h.teams[0]
+	for _, team := range h.teams[1:] {
+		if counts[team] < counts[client.team] {
+			client.team = team
+		}
+	}
+}
+
+// sendTeam tells the client its team, if it has one.
+func (h *Hub) sendTeam(client *Client) {
+	if client.team != "" {
+		h.send(client, rpcEnvelope(rpcTeamAssigned, "", &teamAssigned{Team: client.team}))
+	}
+}
+
+// reassignTeam puts a player that moved to another space in the team of it
+// with the fewest players, and tells it. The entities it was shown stay in
+// the old space.
+func (h *Hub) reassignTeam(client *Client) {
+	client.shown = make(map[entityKey]bool)
+	if len(h.teams) == 0 {
+		return
+	}
+	client.team = ""
+	h.assignTeam(client)
+	h.sendTeam(client)
+}
+
+// teamOnly reports whether e is addressed to the team of its sender.
+func teamOnly(e *server.Envelope) bool {
+	return e != nil && e.GetRpc() != nil && strings.HasPrefix(e.GetRpc().Id, teamRPCPrefix)
+}
+
+// visible reports whether the client may get the message: team rpcs only go
+// to the clients of the sender's team, none if the sender has no team.
+// Entity updates are checked with fogged.
+func (h *Hub) visible(client *Client, message *MessageEnvelope) bool {
+	if teamOnly(message.envelope) {
+		return message.sender.team != "" && client.team == message.sender.team
+	}
+	return true
+}
+
+// fogged reports whether fog of war hides an entity update of the sender from
+// the client: the sender is in another team and no member of the client's
+// team is in range of the entities of sp. Clients without a team see
+// everything. seen caches the answer by team and entity for one message.
+func (h *Hub) fogged(client, sender *Client, sp *server.SpacePresence, seen map[string]bool) bool {
+	if h.fog == nil || client.team == "" || client.team == sender.team {
+		return false
+	}
+	key := client.team
+	for _, entity := range sp.Changes {
+		key += "/" + entity.Id
+	}
+	if v, ok := seen[key]; ok {
+		return v
+	}
+	v := true
+	for _, entity := range sp.Changes {
+		if entity.Position != nil && h.inRange(client, vec3From(entity.Position)) {
+			v = false
+			break
+		}
+	}
+	if seen != nil {
+		seen[key] = v
+	}
+	return v
+}
+
+// foggedAt reports whether fog of war hides from the client an entity of the
+// sender at p.
+func (h *Hub) foggedAt(client, sender *Client, p Vec3) bool {
+	return h.fog != nil && client.team != "" && client.team != sender.team && !h.inRange(client, p)
+}
+
+// inRange reports whether p is within fog range of a member of the team of
+// the client.
+func (h *Hub) inRange(client *Client, p Vec3) bool {
+	if h.fog.Range <= 0 {
+		return false
+	}
+	for c := range h.clients {
+		if c.space != client.space || c.team != client.team {
+			continue
+		}
+		if position, ok := h.positions[c.id]; ok && p.sub(position).length() <= h.fog.Range {
+			return true
+		}
+	}
+	return false
+}
+
+// sendEntityState sends the update of an entity to the client unless fog of
+// war hides it. The client is told when an entity it was shown goes under
+// the fog, so it stops drawing it at its last position.
+func (h *Hub) sendEntityState(client *Client, message *MessageEnvelope, part *statePart, seen map[string]bool, now time.Time) {
+	if h.fogged(client, message.sender, part.sp, seen) {
+		h.hideEntity(client, part.entity)
+		return
+	}
+	if h.fog != nil && client.team != "" && client.team != message.sender.team {
+		client.shown[part.entity] = true
+	}
+	if h.throttle(client, message, part, now) {
+		h.sendState(client, message, part)
+	}
+}
+
+// forgetShown drops a released entity from the entities shown to the
+// clients.
+func (h *Hub) forgetShown(key entityKey) {
+	for client := range h.clients {
+		delete(client.shown, key)
+	}
+}
+
+// hideEntity sends the client an entity_hidden rpc if it was shown the entity,
+// and drops the updates of the entity waiting for it.
+func (h *Hub) hideEntity(client *Client, key entityKey) {
+	if !client.shown[key] {
+		return
+	}
+	delete(client.shown, key)
+	delete(client.lod, key)
+	client.send.dropState(key)
+	h.sendOn(client, laneReliable, rpcEnvelope(rpcEntityHidden, "", &entityHidden{EntityID: key.id}))
+}
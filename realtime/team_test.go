@@ -0,0 +1,141 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"testing"
+
+	"nakama/server"
+)
+
+func TestAssignTeam(t *testing.T) {
+	tests := []struct {
+		name string
+		// Teams of the clients already in the space, and of one in another
+		// space.
+		teams []string
+		other string
+		role  string
+		want  string
+	}{
+		{"empty space", nil, "", RolePlayer, "red"},
+		{"fewest players", []string{"red"}, "", RolePlayer, "blue"},
+		{"tie goes to the first", []string{"red", "blue"}, "", RolePlayer, "red"},
+		{"other spaces not counted", []string{"red"}, "blue", RolePlayer, "blue"},
+		{"spectator", nil, "", RoleSpectator, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Hub{clients: make(map[*Client]bool), teams: []string{"red", "blue"}}
+			for _, team := range tt.teams {
+				h.clients[&Client{space: "s", team: team}] = true
+			}
+			if tt.other != "" {
+				h.clients[&Client{space: "t", team: tt.other}] = true
+			}
+			client := &Client{space: "s", role: tt.role}
+			h.assignTeam(client)
+			if client.team != tt.want {
+				t.Errorf("team %q, want %q", client.team, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoveSpaceReassignsTeam(t *testing.T) {
+	client := &Client{id: "a", space: "s", team: "red", role: RolePlayer, send: newSendQueue(), shown: map[entityKey]bool{{"s", "e"}: true}}
+	h := &Hub{
+		clients:      map[*Client]bool{client: true},
+		entityOwners: make(map[entityKey]*entityOwner),
+		teams:        []string{"red", "blue"},
+	}
+	h.clients[&Client{space: "t", team: "red"}] = true
+	h.moveSpace(client, "t")
+	if client.team != "blue" {
+		t.Errorf("team %q, want blue", client.team)
+	}
+	if n := client.send.len(); n != 1 {
+		t.Errorf("%d messages, want the team_assigned notice", n)
+	}
+	if len(client.shown) != 0 {
+		t.Error("entities of the old space still shown")
+	}
+}
+
+func TestVisible(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		sender string
+		client string
+		want   bool
+	}{
+		{"plain rpc", "chat", "red", "blue", true},
+		{"team rpc to the team", "team:ping", "red", "red", true},
+		{"team rpc to another team", "team:ping", "red", "blue", false},
+		{"team rpc without a team", "team:ping", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Hub{}
+			message := &MessageEnvelope{sender: &Client{team: tt.sender}, envelope: rpcEnvelope(tt.id, "", nil)}
+			if got := h.visible(&Client{team: tt.client}, message); got != tt.want {
+				t.Errorf("visible = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFogged(t *testing.T) {
+	tests := []struct {
+		name string
+		fog  *FogOfWar
+		// Team of the client and of its team mate at the origin.
+		team   string
+		entity Vec3
+		want   bool
+	}{
+		{"no fog", nil, "blue", Vec3{X: 100}, false},
+		{"same team", &FogOfWar{Range: 10}, "red", Vec3{X: 100}, false},
+		{"no team", &FogOfWar{Range: 10}, "", Vec3{X: 100}, false},
+		{"in range", &FogOfWar{Range: 10}, "blue", Vec3{X: 5}, false},
+		{"at range", &FogOfWar{Range: 10}, "blue", Vec3{X: 10}, false},
+		{"out of range", &FogOfWar{Range: 10}, "blue", Vec3{X: 11}, true},
+		{"zero range", &FogOfWar{}, "blue", Vec3{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{id: "c", space: "s", team: tt.team}
+			mate := &Client{id: "m", space: "s", team: tt.team}
+			sender := &Client{id: "o", space: "s", team: "red"}
+			h := &Hub{
+				clients:   map[*Client]bool{client: true, mate: true, sender: true},
+				fog:       tt.fog,
+				positions: map[string]Vec3{"m": {}},
+			}
+			sp := &server.SpacePresence{Changes: []*server.Entity{{Id: "e", Position: &server.V3{X: tt.entity.X, Y: tt.entity.Y, Z: tt.entity.Z}}}}
+			if got := h.fogged(client, sender, sp, nil); got != tt.want {
+				t.Errorf("fogged = %v, want %v", got, tt.want)
+			}
+			if got := h.foggedAt(client, sender, tt.entity); got != tt.want {
+				t.Errorf("foggedAt = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInRangeSameSpaceOnly(t *testing.T) {
+	client := &Client{id: "c", space: "s", team: "blue"}
+	// A team mate at the entity, but in another space.
+	mate := &Client{id: "m", space: "t", team: "blue"}
+	h := &Hub{
+		clients:   map[*Client]bool{client: true, mate: true},
+		fog:       &FogOfWar{Range: 10},
+		positions: map[string]Vec3{"m": {}},
+	}
+	if h.inRange(client, Vec3{}) {
+		t.Error("in range of a team mate in another space")
+	}
+}
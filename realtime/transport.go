@@ -0,0 +1,131 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries the messages between a client and its peer. Read is only
+// called from readPump, Write, WriteClose and Ping only from writePump.
+type Transport interface {
+	// Read returns the next message from the peer. It fails once the peer
+	// has not been heard from for pongWait.
+	Read() ([]byte, error)
+
+	// Write sends the messages to the peer, coalesced when possible.
+	Write(messages [][]byte) error
+
+	// WriteClose tells the peer no more messages will be sent, with a
+	// websocket close code and reason. A zero code closes without a reason.
+	WriteClose(code int, reason string) error
+
+	// Ping checks the peer is still there and measures the round trip
+	// time, every Hub.pingPeriod.
+	Ping() error
+
+	// Close closes the connection. It may be called more than once.
+	Close() error
+}
+
+// wsTransport is a Transport over a websocket connection.
+type wsTransport struct {
+	conn *websocket.Conn
+
+	// Write json text frames rather than protobuf binary frames.
+	text bool
+
+	// Called from Read with the round trip time of each pong.
+	onRTT func(time.Duration)
+}
+
+// rttTransport is implemented by the transports that measure the round trip
+// time of their pings.
+type rttTransport interface {
+	// OnRTT sets the function called with the round trip time of each
+	// ping. It is called before the pumps start.
+	OnRTT(func(time.Duration))
+}
+
+func newWSTransport(conn *websocket.Conn) *wsTransport {
+	t := &wsTransport{conn: conn, text: conn.Subprotocol() == subprotocolJSON}
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(t.pong)
+	return t
+}
+
+// pong extends the read deadline and measures the round trip time from the
+// send time carried by the ping.
+func (t *wsTransport) pong(data string) error {
+	t.conn.SetReadDeadline(time.Now().Add(pongWait))
+	if len(data) == 8 && t.onRTT != nil {
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(data))))
+		t.onRTT(time.Since(sent))
+	}
+	return nil
+}
+
+func (t *wsTransport) OnRTT(f func(time.Duration)) {
+	t.onRTT = f
+}
+
+func (t *wsTransport) Read() ([]byte, error) {
+	_, message, err := t.conn.ReadMessage()
+	if err != nil && websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+		log.Printf("error: %v", err)
+	}
+	return message, err
+}
+
+// Write sends the messages. Json goes in one text frame with one envelope per
+// line. Protobuf is not delimited, so each message goes in a binary frame of
+// its own.
+func (t *wsTransport) Write(messages [][]byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if !t.text {
+		for _, message := range messages {
+			if err := t.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w, err := t.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for i, message := range messages {
+		if i > 0 {
+			w.Write(newline)
+		}
+		w.Write(message)
+	}
+	return w.Close()
+}
+
+func (t *wsTransport) WriteClose(code int, reason string) error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	payload := []byte{}
+	if code != 0 {
+		payload = websocket.FormatCloseMessage(code, reason)
+	}
+	return t.conn.WriteMessage(websocket.CloseMessage, payload)
+}
+
+func (t *wsTransport) Ping() error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+	return t.conn.WriteMessage(websocket.PingMessage, payload)
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}
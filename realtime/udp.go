@@ -0,0 +1,198 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"nakama/server"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// Rpc id a client sends on its websocket to get a udp token.
+	rpcUDPBind = "udp_bind"
+
+	// Largest udp packet sent or read. Bigger messages go over the socket.
+	udpMaxPacket = 1200
+
+	// Size of the token and sequence number header of inbound packets.
+	udpHeaderSize = 16 + 4
+
+	// Size of the sequence number, server time and tick header of outbound
+	// packets.
+	udpOutHeaderSize = 4 + 8 + 8
+
+	// How long listening waits for the address to be released, as the chat
+	// database does for its file lock.
+	udpListenTimeout = time.Second
+)
+
+// udpBind is the json payload of the answer to a udp_bind rpc.
+type udpBind struct {
+	Token string `json:"token"`
+	Port  int    `json:"port"`
+}
+
+// udpPacket is a datagram read from the udp socket.
+type udpPacket struct {
+	token uuid.UUID
+	seq   uint32
+	addr  *net.UDPAddr
+	data  []byte
+}
+
+// udpPeer is the udp side of a client. It is owned by the hub goroutine.
+type udpPeer struct {
+	token uuid.UUID
+
+	// Address the client sends from, nil until its first packet.
+	addr *net.UDPAddr
+
+	// Sequence numbers of the newest inbound and outbound packets.
+	inSeq  uint32
+	outSeq uint32
+}
+
+// UDPChannel carries SpacePresence updates over udp for the clients that
+// bound their websocket session to it. Packets from a client are its 16 bytes
+// token, a big endian sequence number and a protobuf envelope. Packets to a
+// client are a big endian sequence number and a protobuf envelope. Packets
+// older than the newest one received are dropped.
+type UDPChannel struct {
+	conn  *net.UDPConn
+	peers map[uuid.UUID]*Client
+}
+
+func listenUDP(addr string) (*UDPChannel, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// A process being replaced may still hold the address for a moment.
+	deadline := time.Now().Add(udpListenTimeout)
+	conn, err := net.ListenUDP("udp", udpAddr)
+	for err != nil && time.Now().Before(deadline) {
+		time.Sleep(udpListenTimeout / 20)
+		conn, err = net.ListenUDP("udp", udpAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &UDPChannel{conn: conn, peers: make(map[uuid.UUID]*Client)}, nil
+}
+
+// readPump passes the datagrams read from the socket to the hub until the
+// socket is closed or quit is.
+func (u *UDPChannel) readPump(packets chan<- *udpPacket, quit <-chan struct{}) {
+	buf := make([]byte, udpMaxPacket)
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if n <= udpHeaderSize {
+			continue
+		}
+		p := &udpPacket{
+			seq:  binary.BigEndian.Uint32(buf[16:udpHeaderSize]),
+			addr: addr,
+			data: append([]byte(nil), buf[udpHeaderSize:n]...),
+		}
+		copy(p.token[:], buf[:16])
+		select {
+		case packets <- p:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (u *UDPChannel) Close() error {
+	return u.conn.Close()
+}
+
+// newer reports whether sequence number a comes after b, allowing for
+// wraparound.
+func newer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// bindUDP handles a udp_bind rpc.
+func (h *Hub) bindUDP(message *MessageEnvelope, e *server.Envelope) {
+	if h.udp == nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeRejected, "udp disabled"))
+		return
+	}
+	client := message.sender
+	if client.udp != nil {
+		delete(h.udp.peers, client.udp.token)
+	}
+	client.udp = &udpPeer{token: uuid.NewV4()}
+	h.udp.peers[client.udp.token] = client
+	h.send(client, rpcEnvelope(rpcUDPBind, e.CollationId, &udpBind{
+		Token: client.udp.token.String(),
+		Port:  h.udp.conn.LocalAddr().(*net.UDPAddr).Port,
+	}))
+}
+
+// acceptUDP checks a packet against the session of its token. It returns the
+// message to relay, or nil for packets that are stale, unbound or not
+// SpacePresence updates.
+func (h *Hub) acceptUDP(p *udpPacket) *MessageEnvelope {
+	if h.udp == nil {
+		return nil
+	}
+	client, ok := h.udp.peers[p.token]
+	if !ok {
+		return nil
+	}
+	peer := client.udp
+	if peer.addr != nil && !newer(p.seq, peer.inSeq) {
+		return nil
+	}
+	peer.addr = p.addr
+	peer.inSeq = p.seq
+	e := &server.Envelope{}
+	if err := proto.Unmarshal(p.data, e); err != nil || e.GetSpacePresence() == nil {
+		return nil
+	}
+	return &MessageEnvelope{fromClient: client.id, sender: client, data: p.data, receivedAt: time.Now()}
+}
+
+// sendUDP sends data to the client over udp, after the server time and tick
+// it was relayed at. It reports false if the client has no udp address or
+// data does not fit in a packet.
+func (h *Hub) sendUDP(client *Client, tick *serverTick, data []byte) bool {
+	peer := client.udp
+	if h.udp == nil || peer == nil || peer.addr == nil || len(data)+udpOutHeaderSize > udpMaxPacket {
+		return false
+	}
+	peer.outSeq++
+	packet := make([]byte, udpOutHeaderSize+len(data))
+	binary.BigEndian.PutUint32(packet, peer.outSeq)
+	binary.BigEndian.PutUint64(packet[4:], uint64(tick.ServerTime))
+	binary.BigEndian.PutUint64(packet[12:], uint64(tick.Tick))
+	copy(packet[udpOutHeaderSize:], data)
+	if _, err := h.udp.conn.WriteToUDP(packet, peer.addr); err != nil {
+		log.Printf("udp: %v", err)
+	}
+	return true
+}
+
+// unbindUDP forgets the udp session of the client.
+func (h *Hub) unbindUDP(client *Client) {
+	if h.udp != nil && client.udp != nil {
+		delete(h.udp.peers, client.udp.token)
+	}
+}
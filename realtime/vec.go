@@ -0,0 +1,47 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"math"
+
+	"nakama/server"
+)
+
+// Vec3 is a position the server computes with. Protobuf messages are not
+// meant to be copied, so positions are converted from and to server.V3 at the
+// edges.
+type Vec3 struct {
+	X, Y, Z float32
+}
+
+func vec3From(v *server.V3) Vec3 {
+	return Vec3{X: v.X, Y: v.Y, Z: v.Z}
+}
+
+func (v Vec3) V3() *server.V3 {
+	return &server.V3{X: v.X, Y: v.Y, Z: v.Z}
+}
+
+func (v Vec3) add(w Vec3) Vec3 {
+	return Vec3{v.X + w.X, v.Y + w.Y, v.Z + w.Z}
+}
+
+func (v Vec3) sub(w Vec3) Vec3 {
+	return Vec3{v.X - w.X, v.Y - w.Y, v.Z - w.Z}
+}
+
+func (v Vec3) scale(f float32) Vec3 {
+	return Vec3{v.X * f, v.Y * f, v.Z * f}
+}
+
+func (v Vec3) length() float32 {
+	return float32(math.Sqrt(float64(v.X*v.X + v.Y*v.Y + v.Z*v.Z)))
+}
+
+// lerp interpolates between v and w, f going from 0 to 1.
+func (v Vec3) lerp(w Vec3, f float32) Vec3 {
+	return v.add(w.sub(v).scale(f))
+}
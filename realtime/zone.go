@@ -0,0 +1,182 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"encoding/json"
+	"time"
+
+	"nakama/server"
+)
+
+const (
+	// Rpc ids a client sends to get or stop the events of zones.
+	rpcZoneSubscribe   = "zone_subscribe"
+	rpcZoneUnsubscribe = "zone_unsubscribe"
+
+	// Rpc id of the zone events sent to the clients.
+	rpcZoneEvent = "zone_event"
+
+	// Zone id subscribing to every zone of the space.
+	anyZone = "*"
+)
+
+// Kinds of ZoneEvent.
+const (
+	ZoneEnter = "enter"
+	ZoneExit  = "exit"
+)
+
+// Zone is a region of a space, a sphere if Radius is set, else the box
+// between Min and Max.
+type Zone struct {
+	ID string
+
+	Min, Max Vec3
+
+	Center Vec3
+	Radius float32
+}
+
+func (z *Zone) contains(p Vec3) bool {
+	if z.Radius > 0 {
+		return p.sub(z.Center).length() <= z.Radius
+	}
+	return clampf(p.X, z.Min.X, z.Max.X) == p.X &&
+		clampf(p.Y, z.Min.Y, z.Max.Y) == p.Y &&
+		clampf(p.Z, z.Min.Z, z.Max.Z) == p.Z
+}
+
+// ZoneEvent tells that an entity entered or left a zone. It is the json
+// payload of a zone_event rpc.
+type ZoneEvent struct {
+	Event      string `json:"event"`
+	Zone       string `json:"zone"`
+	EntityID   string `json:"entity_id"`
+	UserID     string `json:"user_id"`
+	ServerTime int64  `json:"server_time"`
+}
+
+// zoneRequest is the json payload of the zone_subscribe and zone_unsubscribe
+// rpcs.
+type zoneRequest struct {
+	Zones []string `json:"zones"`
+}
+
+// entityZones is the set of zones an entity is in, and its last position.
+type entityZones struct {
+	owner    *Client
+	position Vec3
+	zones    map[string]bool
+}
+
+// spaceZones returns the zones of the space.
+func (h *Hub) spaceZones(space string) []Zone {
+	if zones, ok := h.zones[space]; ok {
+		return zones
+	}
+	return h.zones[AnySpace]
+}
+
+// crossZones compares the zones the entities of sp are in with the ones they
+// were in, and emits an event for every zone entered or left.
+func (h *Hub) crossZones(sender *Client, sp *server.SpacePresence, now time.Time) {
+	zones := h.spaceZones(sender.space)
+	if len(zones) == 0 {
+		return
+	}
+	for _, e := range sp.Changes {
+		if e.Position == nil {
+			continue
+		}
+		p := vec3From(e.Position)
+		key := entityKey{sender.space, e.Id}
+		in, ok := h.inZones[key]
+		if !ok {
+			in = &entityZones{zones: make(map[string]bool)}
+			h.inZones[key] = in
+		}
+		in.owner, in.position = sender, p
+		for i := range zones {
+			z := &zones[i]
+			inside := z.contains(p)
+			if inside == in.zones[z.ID] {
+				continue
+			}
+			event := &ZoneEvent{Event: ZoneExit, Zone: z.ID, EntityID: e.Id, UserID: sender.id, ServerTime: unixMillis(now)}
+			if inside {
+				event.Event = ZoneEnter
+				in.zones[z.ID] = true
+			} else {
+				delete(in.zones, z.ID)
+			}
+			h.emitZoneEvent(sender, event, p)
+		}
+	}
+}
+
+// exitZones emits the exit events of the entities of a client leaving the
+// space.
+func (h *Hub) exitZones(client *Client) {
+	for key, in := range h.inZones {
+		if in.owner == client {
+			h.exitEntityZones(key)
+		}
+	}
+}
+
+// exitEntityZones emits an exit event for every zone the entity is in, and
+// forgets them.
+func (h *Hub) exitEntityZones(key entityKey) {
+	in, ok := h.inZones[key]
+	if !ok {
+		return
+	}
+	now := unixMillis(time.Now())
+	for zone := range in.zones {
+		h.emitZoneEvent(in.owner, &ZoneEvent{Event: ZoneExit, Zone: zone, EntityID: key.id, UserID: in.owner.id, ServerTime: now}, in.position)
+	}
+	delete(h.inZones, key)
+}
+
+// emitZoneEvent sends the event to the owner of the entity and to the clients
+// of its space subscribed to the zone that fog of war does not hide the
+// entity at position from, then passes it to the hooks.
+func (h *Hub) emitZoneEvent(owner *Client, event *ZoneEvent, position Vec3) {
+	e := rpcEnvelope(rpcZoneEvent, "", event)
+	for client := range h.clients {
+		if client == owner {
+			h.sendOn(client, laneReliable, e)
+			continue
+		}
+		if client.space != owner.space || !(client.zones[event.Zone] || client.zones[anyZone]) {
+			continue
+		}
+		if !h.foggedAt(client, owner, position) {
+			h.sendOn(client, laneReliable, e)
+		}
+	}
+	if hooks, ok := h.hooks.(ZoneHooks); ok {
+		hooks.OnZoneEvent(owner, event)
+	}
+}
+
+// subscribeZones adds or removes zones the sender gets the events of.
+func (h *Hub) subscribeZones(message *MessageEnvelope, e *server.Envelope) {
+	req := &zoneRequest{}
+	if err := json.Unmarshal([]byte(e.GetRpc().Payload), req); err != nil {
+		h.send(message.sender, errorEnvelope(e.CollationId, errCodeBadInput, err.Error()))
+		return
+	}
+	client := message.sender
+	for _, zone := range req.Zones {
+		if e.GetRpc().Id == rpcZoneSubscribe {
+			client.zones[zone] = true
+		} else {
+			delete(client.zones, zone)
+		}
+	}
+	h.send(client, rpcEnvelope(e.GetRpc().Id, e.CollationId, req))
+}
@@ -0,0 +1,110 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"nakama/server"
+)
+
+func TestZoneContains(t *testing.T) {
+	box := Zone{ID: "box", Min: Vec3{X: -1, Y: -1, Z: -1}, Max: Vec3{X: 1, Y: 1, Z: 1}}
+	sphere := Zone{ID: "sphere", Center: Vec3{X: 10}, Radius: 2}
+	tests := []struct {
+		name string
+		zone Zone
+		p    Vec3
+		want bool
+	}{
+		{"box center", box, Vec3{}, true},
+		{"box corner", box, Vec3{X: 1, Y: 1, Z: 1}, true},
+		{"box face", box, Vec3{X: -1}, true},
+		{"outside box on x", box, Vec3{X: 1.5}, false},
+		{"outside box on y", box, Vec3{Y: -1.5}, false},
+		{"outside box on z", box, Vec3{Z: 2}, false},
+		{"sphere center", sphere, Vec3{X: 10}, true},
+		{"sphere surface", sphere, Vec3{X: 12}, true},
+		{"inside sphere bounding box", sphere, Vec3{X: 11.5, Y: 1.5}, false},
+		{"outside sphere", sphere, Vec3{X: 7}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.zone.contains(tt.p); got != tt.want {
+				t.Errorf("contains(%v) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+// newZoneHub returns a hub with a box zone around the origin in space s,
+// and the client owner in it.
+func newZoneHub() (*Hub, *Client) {
+	owner := &Client{id: "o", space: "s", send: newSendQueue(), lod: make(map[entityKey]*lodEntry)}
+	h := &Hub{
+		clients:      map[*Client]bool{owner: true},
+		entityOwners: make(map[entityKey]*entityOwner),
+		history:      newHistory(time.Second),
+		zones:        map[string][]Zone{"s": {{ID: "z", Min: Vec3{X: -1, Y: -1, Z: -1}, Max: Vec3{X: 1, Y: 1, Z: 1}}}},
+		inZones:      make(map[entityKey]*entityZones),
+	}
+	return h, owner
+}
+
+func TestCrossZones(t *testing.T) {
+	tests := []struct {
+		name  string
+		moves []float32
+		// Events sent to the owner, and whether the entity ends in the zone.
+		events int
+		in     bool
+	}{
+		{"enter", []float32{0}, 1, true},
+		{"stay", []float32{0, 0.5}, 1, true},
+		{"enter and exit", []float32{0, 5}, 2, false},
+		{"never in", []float32{5, 6}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, owner := newZoneHub()
+			for _, x := range tt.moves {
+				sp := &server.SpacePresence{Changes: []*server.Entity{{Id: "e", Position: &server.V3{X: x}}}}
+				h.crossZones(owner, sp, time.Now())
+			}
+			if n := owner.send.len(); n != tt.events {
+				t.Errorf("%d events, want %d", n, tt.events)
+			}
+			if in := h.inZones[entityKey{"s", "e"}].zones["z"]; in != tt.in {
+				t.Errorf("in zone = %v, want %v", in, tt.in)
+			}
+		})
+	}
+}
+
+func TestZonesForgotten(t *testing.T) {
+	tests := []struct {
+		name   string
+		forget func(h *Hub, owner *Client)
+	}{
+		{"entity reset", func(h *Hub, owner *Client) { h.resetEntity(entityKey{"s", "e"}) }},
+		{"space move", func(h *Hub, owner *Client) { h.moveSpace(owner, "t") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, owner := newZoneHub()
+			sp := &server.SpacePresence{Changes: []*server.Entity{{Id: "e", Position: &server.V3{}}}}
+			h.crossZones(owner, sp, time.Now())
+			tt.forget(h, owner)
+			if _, ok := h.inZones[entityKey{"s", "e"}]; ok {
+				t.Error("zones of the entity kept")
+			}
+			// The enter event, then the exit one.
+			if n := owner.send.len(); n != 2 {
+				t.Errorf("%d events, want 2", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"ws/realtime"
+)
+
+// restart starts a new instance of the executable with the same arguments and
+// hands it the listener of srv. Once the new process started, srv stops
+// accepting connections and keeps serving its clients until it is shut down.
+// If the new process cannot start, srv is left untouched.
+func restart(srv *realtime.Server) error {
+	f, err := srv.ListenerFile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles[0] is fd 3 in the new process.
+	cmd.ExtraFiles = []*os.File{f}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, listenerFDEnv+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", listenerFDEnv, 3))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	cmd.Process.Release()
+
+	// The new process waits for the chat database and the udp socket while
+	// they are released.
+	if err := srv.Detach(); err != nil {
+		log.Println("detach: ", err)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+
+	"ws/realtime"
+)
+
+// restart is only supported on Linux.
+func restart(srv *realtime.Server) error {
+	return errors.New("listener handoff is not supported on this platform")
+}